@@ -0,0 +1,202 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	cliconfig "github.com/docker/cli/cli/config"
+	clitypes "github.com/docker/cli/cli/config/types"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/flow-contrib/toolkit/utils/secret"
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+)
+
+// the key of docker hub in config.json
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// registryAuth returns the encoded auth of the registry of image, the auth
+// config of step is preferred if its server is the registry of image,
+// otherwise the auth is read from ~/.docker/config.json, including credsStore
+// and credHelpers
+//
+//	auth {
+//	    username     = "ci"
+//	    password-env = "REGISTRY_PASSWORD"   # password, password-file, password-env or password-from-output
+//	    server       = "registry.example.com" # default is the registry of image
+//	}
+func registryAuth(ctx context.Context, conf config.Configuration, image string) (encoded string, err error) {
+
+	server, err := registryServer(image)
+	if err != nil {
+		return
+	}
+
+	auth, matched, err := stepRegistryAuth(ctx, conf, server)
+	if err != nil {
+		return
+	}
+
+	// the credentials of step are never sent to the other registries
+	if !matched {
+		auth, err = loadRegistryAuth(server)
+		if err != nil {
+			return
+		}
+	}
+
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return
+	}
+
+	encoded = base64.URLEncoding.EncodeToString(data)
+
+	return
+}
+
+// stepRegistryAuth reads the auth config of step, matched is false if it is
+// not configured or it is configured for another registry than server
+func stepRegistryAuth(ctx context.Context, conf config.Configuration, server string) (auth types.AuthConfig, matched bool, err error) {
+
+	authConf := conf.GetConfig("auth")
+	if authConf.IsEmpty() {
+		return
+	}
+
+	authServer := authConf.GetString("server", server)
+	if normalizeRegistryServer(authServer) != normalizeRegistryServer(server) {
+		return
+	}
+
+	auth.Username = authConf.GetString("username")
+	auth.ServerAddress = authServer
+
+	auth.Password, err = secret.Resolve(ctx, authConf, "password")
+	if err != nil {
+		return
+	}
+
+	matched = true
+
+	return
+}
+
+func loadRegistryAuth(server string) (auth types.AuthConfig, err error) {
+
+	configFile, err := cliconfig.Load(dockerConfigDir())
+	if err != nil {
+		err = fmt.Errorf("load docker config failure: %s", err)
+		return
+	}
+
+	cliAuth, err := configFile.GetAuthConfig(server)
+	if err != nil {
+		err = fmt.Errorf("get auth of registry %s failure: %s", server, err)
+		return
+	}
+
+	auth = toAuthConfig(cliAuth)
+
+	return
+}
+
+// buildAuthConfigs returns the auths of all registries for the base images
+// of build, the same as docker cli, the auth config of step is added for
+// its server, the default server is docker hub
+func buildAuthConfigs(ctx context.Context, conf config.Configuration) (auths map[string]types.AuthConfig, err error) {
+
+	configFile, err := cliconfig.Load(dockerConfigDir())
+	if err != nil {
+		err = fmt.Errorf("load docker config failure: %s", err)
+		return
+	}
+
+	credentials, err := configFile.GetAllCredentials()
+	if err != nil {
+		err = fmt.Errorf("get auths of registries failure: %s", err)
+		return
+	}
+
+	auths = map[string]types.AuthConfig{}
+
+	for server, cliAuth := range credentials {
+		auths[server] = toAuthConfig(cliAuth)
+	}
+
+	authConf := conf.GetConfig("auth")
+	if authConf.IsEmpty() {
+		return
+	}
+
+	server := authConf.GetString("server", dockerHubServer)
+
+	auth, _, err := stepRegistryAuth(ctx, conf, server)
+	if err != nil {
+		return
+	}
+
+	// the daemon looks up the auth by the host of registry
+	key := normalizeRegistryServer(server)
+	if key == "docker.io" {
+		key = dockerHubServer
+	}
+
+	auths[key] = auth
+
+	return
+}
+
+func toAuthConfig(cliAuth clitypes.AuthConfig) types.AuthConfig {
+	return types.AuthConfig{
+		Username:      cliAuth.Username,
+		Password:      cliAuth.Password,
+		Auth:          cliAuth.Auth,
+		ServerAddress: cliAuth.ServerAddress,
+		IdentityToken: cliAuth.IdentityToken,
+		RegistryToken: cliAuth.RegistryToken,
+	}
+}
+
+// registryServer returns the key of registry in config.json, e.g.:
+// registry.example.com:5000 or https://index.docker.io/v1/ for docker hub
+func registryServer(image string) (server string, err error) {
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		err = fmt.Errorf("parse image %s failure: %s", image, err)
+		return
+	}
+
+	server = reference.Domain(named)
+
+	if server == "docker.io" {
+		server = dockerHubServer
+	}
+
+	return
+}
+
+// normalizeRegistryServer strips the scheme and path of server, the aliases
+// of docker hub are the same registry
+func normalizeRegistryServer(server string) string {
+
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+
+	if i := strings.IndexByte(server, '/'); i >= 0 {
+		server = server[:i]
+	}
+
+	server = strings.ToLower(server)
+
+	switch server {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+
+	return server
+}
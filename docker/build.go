@@ -0,0 +1,225 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type ImageOutput struct {
+	Host   string   `json:"host"`
+	ID     string   `json:"id"`
+	Digest string   `json:"digest,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Size   int64    `json:"size"`
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.docker.image.build", Build)
+}
+
+func Build(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	contextDir, err := filepath.Abs(conf.GetString("build-context", "."))
+	if err != nil {
+		return
+	}
+
+	if fi, errStat := os.Stat(contextDir); errStat != nil || !fi.IsDir() {
+		err = fmt.Errorf("build-context %s is not a directory", contextDir)
+		return
+	}
+
+	dockerfile, err := contextRelativePath(contextDir, conf.GetString("dockerfile", "Dockerfile"))
+	if err != nil {
+		return
+	}
+
+	buildContext, err := tarBuildContext(contextDir, dockerfile)
+	if err != nil {
+		return
+	}
+
+	defer buildContext.Close()
+
+	options := types.ImageBuildOptions{
+		Dockerfile:  filepath.ToSlash(dockerfile),
+		Tags:        conf.GetStringList("tags"),
+		Target:      conf.GetString("target"),
+		NoCache:     conf.GetBoolean("no-cache", false),
+		PullParent:  conf.GetBoolean("pull", false),
+		Platform:    conf.GetString("platform"),
+		Remove:      true,
+		ForceRemove: conf.GetBoolean("force-remove", false),
+		BuildArgs:   map[string]*string{},
+		Labels:      map[string]string{},
+	}
+
+	argsConf := conf.GetConfig("build-args")
+	for _, key := range argsConf.Keys() {
+		value := argsConf.GetString(key)
+		options.BuildArgs[key] = &value
+	}
+
+	labelsConf := conf.GetConfig("labels")
+	for _, key := range labelsConf.Keys() {
+		options.Labels[key] = labelsConf.GetString(key)
+	}
+
+	// the base images of private registries are pulled with them
+	options.AuthConfigs, err = buildAuthConfigs(ctx, conf)
+	if err != nil {
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	resp, err := cli.ImageBuild(c, buildContext, options)
+	if err != nil {
+		err = fmt.Errorf("build image on docker %s failure: %s", clientConf.Host, err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	output := &ImageOutput{Host: clientConf.Host, Tags: options.Tags}
+
+	progress := &progressStream{
+		Out: ioutil.Discard,
+		Aux: func(aux *json.RawMessage) error {
+			result := types.BuildResult{}
+			if json.Unmarshal(*aux, &result) == nil && len(result.ID) > 0 {
+				output.ID = result.ID
+			}
+			return nil
+		},
+	}
+
+	if !conf.GetBoolean("quiet") {
+		progress.Out = os.Stdout
+	}
+
+	if err = progress.Read(resp.Body); err != nil {
+		if len(progress.Step) > 0 {
+			err = fmt.Errorf("build image failure at %q: %s", progress.Step, err)
+			return
+		}
+		err = fmt.Errorf("build image failure: %s", err)
+		return
+	}
+
+	if len(output.ID) == 0 {
+		err = fmt.Errorf("build image finished without image id")
+		return
+	}
+
+	info, _, err := cli.ImageInspectWithRaw(c, output.ID)
+	if err != nil {
+		return
+	}
+
+	output.Size = info.Size
+
+	// the digest only exists after the image is pushed or pulled
+	if len(info.RepoDigests) > 0 {
+		output.Digest = info.RepoDigests[0]
+	}
+
+	logrus.WithField("IMAGE", output.ID).WithField("TAGS", strings.Join(output.Tags, ",")).Infoln("Image built")
+
+	return appendImageOutput(ctx, conf, "build", output)
+}
+
+// contextRelativePath returns the path of file relative to context, the file
+// should be in the context
+func contextRelativePath(contextDir, file string) (rel string, err error) {
+
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(contextDir, file)
+	}
+
+	rel, err = filepath.Rel(contextDir, file)
+	if err != nil {
+		return
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		err = fmt.Errorf("dockerfile %s is outside of context %s", file, contextDir)
+		return
+	}
+
+	if _, err = os.Stat(file); err != nil {
+		err = fmt.Errorf("dockerfile %s not found: %s", file, err)
+		return
+	}
+
+	return
+}
+
+// tarBuildContext streams the context without the files matched by .dockerignore
+func tarBuildContext(contextDir, dockerfile string) (io.ReadCloser, error) {
+
+	excludes, err := readDockerignore(contextDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the daemon needs them even if they are ignored, the same as docker cli
+	if len(excludes) > 0 {
+		excludes = append(excludes, "!"+filepath.ToSlash(dockerfile), "!.dockerignore")
+	}
+
+	return archive.TarWithOptions(contextDir, &archive.TarOptions{
+		ExcludePatterns: excludes,
+		Compression:     archive.Uncompressed,
+	})
+}
+
+func readDockerignore(contextDir string) (excludes []string, err error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(contextDir, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return
+	}
+
+	excludes, err = dockerignore.ReadAll(bytes.NewReader(data))
+	if err != nil {
+		err = fmt.Errorf("parse .dockerignore failure: %s", err)
+		return
+	}
+
+	return
+}
@@ -3,15 +3,16 @@ package docker
 import (
 	"bytes"
 	"context"
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
-	"github.com/flow-contrib/toolkit/utils/shell"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,8 +26,12 @@ func NewDocker(cli *client.Client) (*Docker, error) {
 	}, nil
 }
 
+// NewEnvDocker creates the client from DOCKER_HOST, DOCKER_TLS_VERIFY,
+// DOCKER_CERT_PATH and the current context of docker cli.
+//
+// Deprecated: the handlers create the client by the connection config of step.
 func NewEnvDocker() (*Docker, error) {
-	cli, err := client.NewEnvClient()
+	cli, err := (&clientConfig{TLSVerify: true}).NewClient(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -49,23 +54,46 @@ type ContainerExecutor struct {
 	Ctx       context.Context
 	Stdout    io.Writer
 	Stderr    io.Writer
+	ExitCode  int
 	container string
 	command   Command
 	intput    io.Reader
 }
 
+// ExitError is returned by Exec when the command exits with non zero code
+type ExitError struct {
+	Code int
+}
+
+func (p *ExitError) Error() string {
+	return fmt.Sprintf("exit code %d", p.Code)
+}
+
 func (p *ContainerExecutor) WithStdIn(script []byte) *ContainerExecutor {
 	p.intput = bytes.NewReader(script)
 	return p
 }
 
+// Exec runs the command and waits for the output stream reaching EOF, the
+// exit code is inspected once the stream is drained, so the output is
+// complete when Exec returns. The process is killed if Ctx is done.
 func (p *ContainerExecutor) Exec() (err error) {
 
+	marker, err := newExecMarker()
+	if err != nil {
+		return
+	}
+
 	options := types.ExecConfig{
 		AttachStdin:  true,
 		AttachStderr: true,
 		AttachStdout: true,
 		Cmd:          p.command.Command,
+		Env:          append(p.command.Environment[:len(p.command.Environment):len(p.command.Environment)], execMarkerEnv+"="+marker),
+		User:         p.command.User,
+		WorkingDir:   p.command.WorkingDir,
+		Privileged:   p.command.Privileged,
+		Tty:          p.command.Tty,
 	}
 
 	exec, err := p.client.ContainerExecCreate(p.Ctx, p.container, options)
@@ -79,84 +107,170 @@ func (p *ContainerExecutor) Exec() (err error) {
 	}
 	defer hijacked.Close()
 
-	attachCh := make(chan error, 2)
+	outputCh := make(chan error, 1)
 
 	go func() {
-		_, err := stdcopy.StdCopy(p.Stdout, p.Stderr, hijacked.Reader)
-		if err != nil {
-			attachCh <- err
+		var err error
+		// the output of tty is not multiplexed, stderr is merged into stdout
+		if p.command.Tty {
+			_, err = io.Copy(p.Stdout, hijacked.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(p.Stdout, p.Stderr, hijacked.Reader)
 		}
+		outputCh <- err
 	}()
 
 	go func() {
-
-		var envVariables bytes.Buffer
-		for _, keyValue := range p.command.Environment {
-			envVariables.WriteString("export " + shell.Escape(keyValue) + "\n")
-		}
-
-		stdIn := io.MultiReader(
-			&envVariables,
-			bytes.NewBufferString(p.command.Stdin),
-		)
-
-		_, err := io.Copy(hijacked.Conn, stdIn)
-		hijacked.CloseWrite()
+		// the command may exit without reading stdin, the error of write is expected then
+		_, err := io.Copy(hijacked.Conn, bytes.NewBufferString(p.command.Stdin))
 		if err != nil {
-			attachCh <- err
+			logrus.Debugln("Exec", exec.ID, "write stdin failed:", err)
 		}
-	}()
-
-	waitCh := make(chan error, 1)
-	go func() {
-		waitCh <- p.waitForExec(p.Ctx, exec.ID)
+		hijacked.CloseWrite()
 	}()
 
 	select {
 	case <-p.Ctx.Done():
-		err = errors.New("Aborted")
-	case err = <-attachCh:
-		logrus.Debugln("Exec", exec.ID, "finished with", err)
-	case err = <-waitCh:
-		logrus.Debugln("Exec", exec.ID, "finished with", err)
+		err = p.abort(exec.ID, marker)
+		return
+	case err = <-outputCh:
+		if err != nil {
+			return
+		}
 	}
 
-	return
+	logrus.Debugln("Exec", exec.ID, "output drained")
+
+	return p.inspectExec(exec.ID, marker)
 }
 
-func (p *ContainerExecutor) waitForExec(ctx context.Context, id string) error {
-	logrus.Debugln("Waiting for exec", id, "...")
+// inspectExec reads the exit code after the output is drained, the state of
+// exec is updated by daemon right after the stream closed, so it is retried
+// with a short backoff in case of racing
+func (p *ContainerExecutor) inspectExec(id, marker string) (err error) {
 
-	retries := 0
+	backoff := time.Millisecond * 10
 
 	for {
-		exec, err := p.client.ContainerExecInspect(ctx, id)
-
+		var exec types.ContainerExecInspect
+		exec, err = p.client.ContainerExecInspect(p.Ctx, id)
 		if err != nil {
-			if client.IsErrNotFound(err) {
-				return err
-			}
+			return
+		}
+
+		if !exec.Running {
+			p.ExitCode = exec.ExitCode
 
-			if retries > 3 {
-				return err
+			if exec.ExitCode != 0 {
+				return &ExitError{Code: exec.ExitCode}
 			}
 
-			retries++
-			time.Sleep(time.Second)
-			continue
+			return nil
+		}
+
+		select {
+		case <-p.Ctx.Done():
+			return p.abort(id, marker)
+		case <-time.After(backoff):
+		}
+
+		if backoff < time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// the env of exec, so the processes started by exec are found in container,
+// there is no api to kill an exec
+const execMarkerEnv = "TOOLKIT_EXEC_ID"
+
+// abort kills the processes of exec after Ctx is done, the processes keep
+// running in container if the kill failed
+func (p *ContainerExecutor) abort(id, marker string) error {
+
+	if err := p.kill(id, marker); err != nil {
+		logrus.WithField("EXEC", id).WithField("CONTAINER", p.container).Warnln("Kill exec failed:", err)
+		return fmt.Errorf("exec aborted; process may still be running: %s, kill failure: %s", p.Ctx.Err(), err)
+	}
+
+	logrus.WithField("EXEC", id).WithField("CONTAINER", p.container).Infoln("Exec killed")
+
+	return fmt.Errorf("exec aborted: %s", p.Ctx.Err())
+}
+
+// kill sends SIGKILL to the processes of exec, they are found by the marker
+// in /proc/<pid>/environ, the container should have /bin/sh, tr and grep, and
+// the user root is allowed to exec
+func (p *ContainerExecutor) kill(id, marker string) (err error) {
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	script := fmt.Sprintf(`command -v tr >/dev/null && command -v grep >/dev/null || { echo "tr and grep are required" >&2; exit 127; }; `+
+		`for d in /proc/[0-9]*; do if tr '\0' '\n' 2>/dev/null < "$d/environ" | grep -qx '%s=%s'; then kill -9 "${d#/proc/}" 2>/dev/null; fi; done`, execMarkerEnv, marker)
+
+	options := types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"/bin/sh", "-c", script},
+		User:         "root",
+	}
+
+	killer, err := p.client.ContainerExecCreate(c, p.container, options)
+	if err != nil {
+		return
+	}
+
+	hijacked, err := p.client.ContainerExecAttach(c, killer.ID, options)
+	if err != nil {
+		return
+	}
+	defer hijacked.Close()
+
+	output := bytes.NewBuffer(nil)
+
+	if _, err = stdcopy.StdCopy(output, output, hijacked.Reader); err != nil {
+		return
+	}
+
+	// the state may lag behind the end of stream for a moment
+	var info types.ContainerExecInspect
+	for {
+		info, err = p.client.ContainerExecInspect(c, killer.ID)
+		if err != nil || !info.Running {
+			break
 		}
 
-		retries = 0
+		select {
+		case <-c.Done():
+			err = c.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
 
-		if exec.Running {
-			time.Sleep(time.Second)
-			continue
+		if err != nil {
+			break
 		}
+	}
 
-		if exec.ExitCode != 0 {
-			return fmt.Errorf("exit code %d", exec.ExitCode)
+	if err != nil {
+		return
+	}
+
+	if info.ExitCode != 0 {
+		err = fmt.Errorf("exit code %d", info.ExitCode)
+		if output.Len() > 0 {
+			err = fmt.Errorf("%s, details: %s", err, strings.TrimSpace(output.String()))
 		}
+		return
+	}
+
+	return
+}
 
-		return nil
+func newExecMarker() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
 }
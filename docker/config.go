@@ -0,0 +1,257 @@
+package docker
+
+import (
+	goctx "context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/gogap/config"
+)
+
+// clientConfig is the connection of docker daemon, the host is resolved in
+// order of host, context, DOCKER_HOST and the current context of docker cli,
+// the default is the local unix socket
+type clientConfig struct {
+	Host       string
+	Context    string
+	APIVersion string
+
+	// TLS is enabled by tls-verify or certs, the certificate of server is
+	// verified unless tls-verify = false
+	TLS       bool
+	TLSVerify bool
+	CertPath  string
+	CACert    string
+	Cert      string
+	Key       string
+}
+
+func newClientConfig(conf config.Configuration) (cfg *clientConfig, err error) {
+	cfg = &clientConfig{
+		Host:       conf.GetString("host"),
+		Context:    conf.GetString("context"),
+		APIVersion: conf.GetString("api-version"),
+		CertPath:   conf.GetString("cert-path"),
+		CACert:     conf.GetString("tls-ca-cert"),
+		Cert:       conf.GetString("tls-cert"),
+		Key:        conf.GetString("tls-key"),
+		TLSVerify:  true,
+	}
+
+	// tls-verify = "1", "0", true or false
+	if tlsVerify := conf.GetString("tls-verify"); len(tlsVerify) > 0 {
+		cfg.TLSVerify, err = strconv.ParseBool(tlsVerify)
+		if err != nil {
+			err = fmt.Errorf("invalid tls-verify %q, should be one of true, false, 1 or 0", tlsVerify)
+			return
+		}
+		cfg.TLS = cfg.TLSVerify
+	}
+
+	cfg.TLS = cfg.TLS || len(cfg.CertPath) > 0 || len(cfg.CACert) > 0 || len(cfg.Cert) > 0
+
+	return
+}
+
+// NewClient creates the client without touching the environment of process,
+// the caller should close it, the tunnel of ssh:// host is closed with it
+func (p *clientConfig) NewClient(ctx goctx.Context) (cli *client.Client, err error) {
+
+	if err = p.resolve(); err != nil {
+		return
+	}
+
+	opts := []func(*client.Client) error{}
+
+	if p.TLS {
+		var httpClient *http.Client
+		httpClient, err = p.httpClient()
+		if err != nil {
+			return
+		}
+		opts = append(opts, client.WithHTTPClient(httpClient))
+	}
+
+	helper, err := connhelper.GetConnectionHelper(p.Host)
+	if err != nil {
+		return
+	}
+
+	if helper != nil {
+		// ssh://user@host, the connection is tunneled by `docker system dial-stdio` on the remote
+		opts = append(opts, client.WithHTTPClient(&http.Client{Transport: &http.Transport{DialContext: helper.Dialer}}))
+		opts = append(opts, client.WithHost(helper.Host), client.WithDialContext(helper.Dialer))
+	} else {
+		opts = append(opts, client.WithHost(p.Host))
+	}
+
+	if len(p.APIVersion) > 0 {
+		opts = append(opts, client.WithVersion(p.APIVersion))
+	}
+
+	cli, err = client.NewClientWithOpts(opts...)
+	if err != nil {
+		return
+	}
+
+	if len(p.APIVersion) == 0 {
+		cli.NegotiateAPIVersion(ctx)
+	}
+
+	return
+}
+
+func (p *clientConfig) resolve() (err error) {
+
+	if len(p.Host) > 0 {
+		return
+	}
+
+	name := p.Context
+
+	if len(name) == 0 {
+		if host := os.Getenv("DOCKER_HOST"); len(host) > 0 {
+			p.Host = host
+
+			// the same as docker cli, TLS is enabled by any value of DOCKER_TLS_VERIFY
+			if len(os.Getenv("DOCKER_TLS_VERIFY")) > 0 {
+				p.TLS = true
+			}
+
+			if certPath := os.Getenv("DOCKER_CERT_PATH"); len(certPath) > 0 && len(p.CertPath) == 0 {
+				p.CertPath = certPath
+				p.TLS = true
+			}
+
+			return
+		}
+
+		name = currentDockerContext()
+	}
+
+	if len(name) > 0 && name != "default" {
+		return p.loadContext(name)
+	}
+
+	p.Host = client.DefaultDockerHost
+
+	return
+}
+
+func (p *clientConfig) httpClient() (*http.Client, error) {
+
+	opts := tlsconfig.Options{
+		CAFile:             p.CACert,
+		CertFile:           p.Cert,
+		KeyFile:            p.Key,
+		InsecureSkipVerify: !p.TLSVerify,
+	}
+
+	// cert-path is the directory of ca.pem, cert.pem and key.pem, the same as DOCKER_CERT_PATH
+	if len(p.CertPath) > 0 {
+		if len(opts.CAFile) == 0 {
+			opts.CAFile = filepath.Join(p.CertPath, "ca.pem")
+		}
+
+		if len(opts.CertFile) == 0 {
+			opts.CertFile = filepath.Join(p.CertPath, "cert.pem")
+		}
+
+		if len(opts.KeyFile) == 0 {
+			opts.KeyFile = filepath.Join(p.CertPath, "key.pem")
+		}
+	}
+
+	tlsConf, err := tlsconfig.Client(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport:     &http.Transport{TLSClientConfig: tlsConf},
+		CheckRedirect: client.CheckRedirect,
+	}, nil
+}
+
+type dockerContextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints map[string]struct {
+		Host          string `json:"Host"`
+		SkipTLSVerify bool   `json:"SkipTLSVerify"`
+	} `json:"Endpoints"`
+}
+
+// loadContext reads the endpoint of context created by `docker context create`
+func (p *clientConfig) loadContext(name string) (err error) {
+
+	id := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+
+	data, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "contexts", "meta", id, "meta.json"))
+	if err != nil {
+		err = fmt.Errorf("read docker context %s failure: %s", name, err)
+		return
+	}
+
+	meta := dockerContextMeta{}
+	if err = json.Unmarshal(data, &meta); err != nil {
+		err = fmt.Errorf("parse docker context %s failure: %s", name, err)
+		return
+	}
+
+	endpoint, exist := meta.Endpoints["docker"]
+	if !exist || len(endpoint.Host) == 0 {
+		err = fmt.Errorf("docker context %s has no docker endpoint", name)
+		return
+	}
+
+	p.Host = endpoint.Host
+
+	tlsDir := filepath.Join(dockerConfigDir(), "contexts", "tls", id, "docker")
+
+	if _, errStat := os.Stat(tlsDir); errStat == nil {
+		p.CertPath = tlsDir
+		p.TLS = true
+		p.TLSVerify = !endpoint.SkipTLSVerify
+	}
+
+	return
+}
+
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); len(dir) > 0 {
+		return dir
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".docker")
+}
+
+// currentDockerContext returns DOCKER_CONTEXT or the currentContext of config.json
+func currentDockerContext() string {
+	if name := os.Getenv("DOCKER_CONTEXT"); len(name) > 0 {
+		return name
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err != nil {
+		return ""
+	}
+
+	cfg := struct {
+		CurrentContext string `json:"currentContext"`
+	}{}
+
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return ""
+	}
+
+	return cfg.CurrentContext
+}
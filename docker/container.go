@@ -0,0 +1,744 @@
+package docker
+
+import (
+	"bytes"
+	goctx "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type PortMapping struct {
+	ContainerPort string `json:"container_port"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"host_ip"`
+	HostPort      string `json:"host_port"`
+}
+
+type ContainerOutput struct {
+	Host     string        `json:"host"`
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Image    string        `json:"image"`
+	Status   string        `json:"status"`
+	Health   string        `json:"health,omitempty"`
+	ExitCode int           `json:"exit_code"`
+	Ports    []PortMapping `json:"ports,omitempty"`
+	Output   string        `json:"output,omitempty"`
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.docker.container.run", Run)
+	flow.RegisterHandler("toolkit.docker.container.start", Start)
+	flow.RegisterHandler("toolkit.docker.container.stop", Stop)
+	flow.RegisterHandler("toolkit.docker.container.remove", Remove)
+	flow.RegisterHandler("toolkit.docker.container.wait", Wait)
+}
+
+// Run creates and starts the container, the step waits for the container
+// exiting unless detach = true, with wait-healthy = true the detached
+// container should be healthy before the step finished
+func Run(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	image := conf.GetString("image")
+	if len(image) == 0 {
+		err = fmt.Errorf("config of image could not be empty, e.g.: image = \"postgres:10\"")
+		return
+	}
+
+	containerConf, hostConf, networkConf, err := newContainerConfig(conf)
+	if err != nil {
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	name := conf.GetString("name")
+
+	created, err := cli.ContainerCreate(c, containerConf, hostConf, networkConf, name)
+	if err != nil && client.IsErrNotFound(err) && conf.GetBoolean("pull", true) {
+		logrus.WithField("IMAGE", image).Infoln("Image not found, pulling")
+
+		if err = pullImage(ctx, c, cli, conf, image); err != nil {
+			err = fmt.Errorf("pull image %s failure: %s", image, err)
+			return
+		}
+		created, err = cli.ContainerCreate(c, containerConf, hostConf, networkConf, name)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("create container of image %s on docker %s failure: %s", image, clientConf.Host, err)
+		return
+	}
+
+	for _, warning := range created.Warnings {
+		logrus.WithField("CONTAINER", created.ID).Warnln(warning)
+	}
+
+	// the daemon only removes the auto-remove container after it exited, the
+	// container which is never started or left running by the failed step is
+	// removed here
+	exited := false
+
+	defer func() {
+		if err != nil && hostConf.AutoRemove && !exited {
+			removeCreatedContainer(cli, created.ID)
+		}
+	}()
+
+	// the first network is attached by create, the others are connected before start
+	networks := conf.GetStringList("networks")
+	for i := 1; i < len(networks); i++ {
+		err = cli.NetworkConnect(c, networks[i], created.ID, &network.EndpointSettings{Aliases: conf.GetStringList("network-aliases")})
+		if err != nil {
+			err = fmt.Errorf("connect container %s to network %s failure: %s", created.ID, networks[i], err)
+			return
+		}
+	}
+
+	detach := conf.GetBoolean("detach", false)
+
+	var waitCh <-chan container.ContainerWaitOKBody
+	var waitErrCh <-chan error
+	var streamCh <-chan error
+
+	outWriter := bytes.NewBuffer(nil)
+	errWriter := bytes.NewBuffer(nil)
+
+	if !detach {
+		// the output is attached and the wait is registered before start, the
+		// same as docker cli, the short-lived auto-remove container may be gone
+		// before the logs could be read
+		var closeStream func()
+		streamCh, closeStream, err = attachContainer(c, cli, created.ID, conf.GetBoolean("quiet"), outWriter, errWriter)
+		if err != nil {
+			err = fmt.Errorf("attach container %s failure: %s", created.ID, err)
+			return
+		}
+
+		defer closeStream()
+
+		condition := container.WaitConditionNextExit
+		if hostConf.AutoRemove {
+			condition = container.WaitConditionRemoved
+		}
+		waitCh, waitErrCh = cli.ContainerWait(c, created.ID, condition)
+	}
+
+	if err = cli.ContainerStart(c, created.ID, types.ContainerStartOptions{}); err != nil {
+		err = fmt.Errorf("start container %s failure: %s", created.ID, err)
+		return
+	}
+
+	logrus.WithField("CONTAINER", created.ID).WithField("IMAGE", image).Infoln("Container started")
+
+	output := &ContainerOutput{Host: clientConf.Host, ID: created.ID, Image: image}
+
+	if detach {
+		if conf.GetBoolean("wait-healthy", false) {
+			if err = waitHealthy(c, cli, created.ID); err != nil {
+				return
+			}
+		}
+
+		if err = inspectContainer(c, cli, created.ID, output); err != nil {
+			return
+		}
+
+		return appendContainerOutput(ctx, conf, "run", output)
+	}
+
+	select {
+	case <-c.Done():
+		err = fmt.Errorf("wait container %s failure: %s", created.ID, c.Err())
+		return
+	case err = <-waitErrCh:
+		err = fmt.Errorf("wait container %s failure: %s", created.ID, err)
+		return
+	case result := <-waitCh:
+		exited = true
+		output.ExitCode = int(result.StatusCode)
+	}
+
+	// the stream ends after the container exited, the rest of output is drained
+	select {
+	case <-c.Done():
+		err = fmt.Errorf("read output of container %s failure: %s", created.ID, c.Err())
+		return
+	case err = <-streamCh:
+		if err != nil {
+			err = fmt.Errorf("read output of container %s failure: %s", created.ID, err)
+			return
+		}
+	}
+
+	output.Status = "exited"
+	output.Output = strings.TrimSuffix(outWriter.String(), "\n")
+
+	if !hostConf.AutoRemove {
+		if err = inspectContainer(c, cli, created.ID, output); err != nil {
+			return
+		}
+	}
+
+	if err = appendContainerOutput(ctx, conf, "run", output); err != nil {
+		return
+	}
+
+	if output.ExitCode != 0 {
+		err = fmt.Errorf("container %s exited with code %d", created.ID, output.ExitCode)
+		if errWriter.Len() > 0 {
+			err = fmt.Errorf("%s, details: %s", err, strings.TrimSuffix(errWriter.String(), "\n"))
+		}
+		return
+	}
+
+	return
+}
+
+func Start(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	id := conf.GetString("container")
+	if len(id) == 0 {
+		err = fmt.Errorf("please input container name or id")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	if err = cli.ContainerStart(c, id, types.ContainerStartOptions{}); err != nil {
+		err = fmt.Errorf("start container %s on docker %s failure: %s", id, clientConf.Host, err)
+		return
+	}
+
+	if conf.GetBoolean("wait-healthy", false) {
+		if err = waitHealthy(c, cli, id); err != nil {
+			return
+		}
+	}
+
+	output := &ContainerOutput{Host: clientConf.Host}
+
+	if err = inspectContainer(c, cli, id, output); err != nil {
+		return
+	}
+
+	logrus.WithField("CONTAINER", output.ID).Infoln("Container started")
+
+	return appendContainerOutput(ctx, conf, "start", output)
+}
+
+func Stop(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	id := conf.GetString("container")
+	if len(id) == 0 {
+		err = fmt.Errorf("please input container name or id")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	// the container is killed after the grace period
+	var grace *time.Duration
+	if conf.GetString("grace-period") != "" {
+		d := conf.GetTimeDuration("grace-period")
+		grace = &d
+	}
+
+	err = cli.ContainerStop(c, id, grace)
+	if err != nil {
+		if client.IsErrNotFound(err) && conf.GetBoolean("ignore-missing", false) {
+			logrus.WithField("CONTAINER", id).Infoln("Container not found, skip stop")
+			return nil
+		}
+		err = fmt.Errorf("stop container %s on docker %s failure: %s", id, clientConf.Host, err)
+		return
+	}
+
+	output := &ContainerOutput{Host: clientConf.Host}
+
+	if err = inspectContainer(c, cli, id, output); err != nil {
+		return
+	}
+
+	logrus.WithField("CONTAINER", output.ID).Infoln("Container stopped")
+
+	return appendContainerOutput(ctx, conf, "stop", output)
+}
+
+func Remove(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	id := conf.GetString("container")
+	if len(id) == 0 {
+		err = fmt.Errorf("please input container name or id")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	options := types.ContainerRemoveOptions{
+		Force:         conf.GetBoolean("force", false),
+		RemoveVolumes: conf.GetBoolean("volumes", false),
+	}
+
+	err = cli.ContainerRemove(c, id, options)
+	if err != nil {
+		if client.IsErrNotFound(err) && conf.GetBoolean("ignore-missing", false) {
+			logrus.WithField("CONTAINER", id).Infoln("Container not found, skip remove")
+			return nil
+		}
+		err = fmt.Errorf("remove container %s on docker %s failure: %s", id, clientConf.Host, err)
+		return
+	}
+
+	logrus.WithField("CONTAINER", id).Infoln("Container removed")
+
+	return appendContainerOutput(ctx, conf, "remove", &ContainerOutput{Host: clientConf.Host, ID: id, Status: "removed"})
+}
+
+// Wait waits for the container exiting, or being healthy with for = "healthy"
+func Wait(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	id := conf.GetString("container")
+	if len(id) == 0 {
+		err = fmt.Errorf("please input container name or id")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	output := &ContainerOutput{Host: clientConf.Host}
+
+	switch waitFor := conf.GetString("for", "exit"); waitFor {
+	case "healthy":
+		if err = waitHealthy(c, cli, id); err != nil {
+			return
+		}
+	case "exit":
+		waitCh, waitErrCh := cli.ContainerWait(c, id, container.WaitConditionNotRunning)
+
+		select {
+		case <-c.Done():
+			err = fmt.Errorf("wait container %s failure: %s", id, c.Err())
+			return
+		case err = <-waitErrCh:
+			err = fmt.Errorf("wait container %s failure: %s", id, err)
+			return
+		case <-waitCh:
+		}
+	default:
+		err = fmt.Errorf("unknown wait for: %s, should be exit or healthy", waitFor)
+		return
+	}
+
+	if err = inspectContainer(c, cli, id, output); err != nil {
+		return
+	}
+
+	if err = appendContainerOutput(ctx, conf, "wait", output); err != nil {
+		return
+	}
+
+	if output.Status == "exited" && output.ExitCode != 0 && !conf.GetBoolean("ignore-exit-code", false) {
+		err = fmt.Errorf("container %s exited with code %d", id, output.ExitCode)
+		return
+	}
+
+	return
+}
+
+func newContainerConfig(conf config.Configuration) (containerConf *container.Config, hostConf *container.HostConfig, networkConf *network.NetworkingConfig, err error) {
+
+	exposed, bindings, err := nat.ParsePortSpecs(conf.GetStringList("ports"))
+	if err != nil {
+		err = fmt.Errorf("parse ports failure: %s", err)
+		return
+	}
+
+	containerConf = &container.Config{
+		Image:        conf.GetString("image"),
+		Cmd:          conf.GetStringList("command"),
+		Entrypoint:   conf.GetStringList("entrypoint"),
+		Env:          conf.GetStringList("environment"),
+		User:         conf.GetString("user"),
+		WorkingDir:   conf.GetString("working-dir"),
+		ExposedPorts: exposed,
+		Labels:       map[string]string{},
+	}
+
+	labelsConf := conf.GetConfig("labels")
+	for _, key := range labelsConf.Keys() {
+		containerConf.Labels[key] = labelsConf.GetString(key)
+	}
+
+	if healthConf := conf.GetConfig("healthcheck"); !healthConf.IsEmpty() {
+		containerConf.Healthcheck = &container.HealthConfig{
+			Test:        healthConf.GetStringList("test"),
+			Interval:    healthConf.GetTimeDuration("interval", 0),
+			Timeout:     healthConf.GetTimeDuration("timeout", 0),
+			StartPeriod: healthConf.GetTimeDuration("start-period", 0),
+			Retries:     int(healthConf.GetInt32("retries", 0)),
+		}
+	}
+
+	restart, err := parseRestartPolicy(conf.GetString("restart", "no"))
+	if err != nil {
+		return
+	}
+
+	hostConf = &container.HostConfig{
+		Binds:           conf.GetStringList("volumes"),
+		PortBindings:    bindings,
+		PublishAllPorts: conf.GetBoolean("publish-all", false),
+		RestartPolicy:   restart,
+		AutoRemove:      conf.GetBoolean("auto-remove", false),
+		Privileged:      conf.GetBoolean("privileged", false),
+	}
+
+	if err = parseResources(conf.GetConfig("resources"), &hostConf.Resources); err != nil {
+		return
+	}
+
+	networkConf = &network.NetworkingConfig{}
+
+	if networks := conf.GetStringList("networks"); len(networks) > 0 {
+		hostConf.NetworkMode = container.NetworkMode(networks[0])
+		networkConf.EndpointsConfig = map[string]*network.EndpointSettings{
+			networks[0]: {Aliases: conf.GetStringList("network-aliases")},
+		}
+	}
+
+	return
+}
+
+// parseRestartPolicy parses no, always, unless-stopped and on-failure[:max-retries]
+func parseRestartPolicy(policy string) (restart container.RestartPolicy, err error) {
+
+	parts := strings.SplitN(policy, ":", 2)
+
+	restart.Name = parts[0]
+
+	switch restart.Name {
+	case "no", "always", "unless-stopped":
+		if len(parts) > 1 {
+			err = fmt.Errorf("max retries is only allowed with on-failure, got restart: %s", policy)
+			return
+		}
+	case "on-failure":
+		if len(parts) > 1 {
+			restart.MaximumRetryCount, err = strconv.Atoi(parts[1])
+			if err != nil {
+				err = fmt.Errorf("parse max retries of restart %s failure: %s", policy, err)
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown restart policy: %s, should be one of no, always, unless-stopped or on-failure[:max-retries]", policy)
+		return
+	}
+
+	return
+}
+
+// parseResources reads memory = "512m", memory-swap = "1g", cpus = "1.5", cpu-shares and pids-limit
+func parseResources(conf config.Configuration, resources *container.Resources) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	if memory := conf.GetString("memory"); len(memory) > 0 {
+		if resources.Memory, err = units.RAMInBytes(memory); err != nil {
+			err = fmt.Errorf("parse memory %s failure: %s", memory, err)
+			return
+		}
+	}
+
+	if swap := conf.GetString("memory-swap"); len(swap) > 0 {
+		if swap == "-1" {
+			resources.MemorySwap = -1
+		} else if resources.MemorySwap, err = units.RAMInBytes(swap); err != nil {
+			err = fmt.Errorf("parse memory-swap %s failure: %s", swap, err)
+			return
+		}
+	}
+
+	if cpus := conf.GetString("cpus"); len(cpus) > 0 {
+		var n float64
+		if n, err = strconv.ParseFloat(cpus, 64); err != nil {
+			err = fmt.Errorf("parse cpus %s failure: %s", cpus, err)
+			return
+		}
+		resources.NanoCPUs = int64(n * 1e9)
+	}
+
+	resources.CPUShares = conf.GetInt64("cpu-shares", 0)
+	resources.PidsLimit = conf.GetInt64("pids-limit", 0)
+
+	return
+}
+
+// waitHealthy polls the health status, the container without healthcheck is
+// treated as healthy once it is running
+func waitHealthy(c goctx.Context, cli *client.Client, id string) (err error) {
+
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+
+	for {
+		var info types.ContainerJSON
+		info, err = cli.ContainerInspect(c, id)
+		if err != nil {
+			return
+		}
+
+		if info.State == nil {
+			err = fmt.Errorf("container %s has no state", id)
+			return
+		}
+
+		if !info.State.Running {
+			err = fmt.Errorf("container %s is %s with exit code %d before healthy", id, info.State.Status, info.State.ExitCode)
+			return
+		}
+
+		if info.State.Health == nil || info.State.Health.Status == types.Healthy {
+			logrus.WithField("CONTAINER", id).Infoln("Container is healthy")
+			return
+		}
+
+		if info.State.Health.Status == types.Unhealthy {
+			err = fmt.Errorf("container %s is unhealthy", id)
+			if n := len(info.State.Health.Log); n > 0 {
+				err = fmt.Errorf("%s, details: %s", err, strings.TrimSpace(info.State.Health.Log[n-1].Output))
+			}
+			return
+		}
+
+		select {
+		case <-c.Done():
+			err = fmt.Errorf("wait container %s healthy failure: %s", id, c.Err())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// attachContainer attaches the stdout and stderr of the created container,
+// the output is copied until the container exits, the result is sent to done
+func attachContainer(c goctx.Context, cli *client.Client, id string, quiet bool, outWriter, errWriter io.Writer) (done <-chan error, closeStream func(), err error) {
+
+	resp, err := cli.ContainerAttach(c, id, types.ContainerAttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return
+	}
+
+	stdOut, stdErr := outWriter, errWriter
+
+	if !quiet {
+		stdOut = io.MultiWriter(outWriter, os.Stdout)
+		stdErr = io.MultiWriter(errWriter, os.Stderr)
+	}
+
+	copyCh := make(chan error, 1)
+
+	go func() {
+		_, e := stdcopy.StdCopy(stdOut, stdErr, resp.Reader)
+		copyCh <- e
+	}()
+
+	return copyCh, resp.Close, nil
+}
+
+// removeCreatedContainer force removes the container left by the failed run,
+// the context of step may be already done, so a new one is used
+func removeCreatedContainer(cli *client.Client, id string) {
+
+	c, cancel := goctx.WithTimeout(goctx.Background(), time.Second*30)
+	defer cancel()
+
+	err := cli.ContainerRemove(c, id, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		logrus.WithField("CONTAINER", id).WithError(err).Warnln("Remove container failure")
+		return
+	}
+
+	logrus.WithField("CONTAINER", id).Infoln("Container removed")
+}
+
+func inspectContainer(c goctx.Context, cli *client.Client, id string, output *ContainerOutput) (err error) {
+
+	info, err := cli.ContainerInspect(c, id)
+	if err != nil {
+		return
+	}
+
+	output.ID = info.ID
+	output.Name = strings.TrimPrefix(info.Name, "/")
+	output.Image = info.Config.Image
+
+	if info.State != nil {
+		output.Status = info.State.Status
+		output.ExitCode = info.State.ExitCode
+
+		if info.State.Health != nil {
+			output.Health = info.State.Health.Status
+		}
+	}
+
+	output.Ports = nil
+
+	if info.NetworkSettings != nil {
+		for port, bindings := range info.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				output.Ports = append(output.Ports, PortMapping{
+					ContainerPort: port.Port(),
+					Protocol:      port.Proto(),
+					HostIP:        binding.HostIP,
+					HostPort:      binding.HostPort,
+				})
+			}
+		}
+	}
+
+	sort.Slice(output.Ports, func(i, j int) bool {
+		a, b := output.Ports[i], output.Ports[j]
+		if a.ContainerPort != b.ContainerPort {
+			return a.ContainerPort < b.ContainerPort
+		}
+		return a.HostIP < b.HostIP
+	})
+
+	return
+}
+
+func appendContainerOutput(ctx context.Context, conf config.Configuration, action string, output *ContainerOutput) (err error) {
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{
+		Name:  outputName,
+		Value: data,
+		Tags:  []string{"toolkit", "docker", action},
+	})
+
+	return
+}
+
+func newStepContext(conf config.Configuration) (goctx.Context, goctx.CancelFunc) {
+	if timeout := conf.GetTimeDuration("timeout", 0); timeout > 0 {
+		return goctx.WithTimeout(goctx.Background(), timeout)
+	}
+	return goctx.WithCancel(goctx.Background())
+}
@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/flow-contrib/toolkit/utils/secret"
 	"github.com/gogap/config"
 	"github.com/gogap/context"
 	"github.com/gogap/flow"
@@ -20,17 +21,23 @@ type Command struct {
 	Environment []string `json:"environment"`
 	Command     []string `json:"command"`
 	Stdin       string   `json:"stdin"`
+	User        string   `json:"user,omitempty"`
+	WorkingDir  string   `json:"working_dir,omitempty"`
+	Privileged  bool     `json:"privileged,omitempty"`
+	Tty         bool     `json:"tty,omitempty"`
 }
 
 type OutputValue struct {
-	Host    string  `json:"host"`
-	Command Command `json:"command"`
-	Output  string  `json:"output"`
+	Host     string  `json:"host"`
+	Command  Command `json:"command"`
+	Output   string  `json:"output"`
+	Stderr   string  `json:"stderr"`
+	ExitCode int     `json:"exit_code"`
+	Duration string  `json:"duration"`
 }
 
 func init() {
 	flow.RegisterHandler("toolkit.docker.container.exec", Exec)
-	flow.RegisterHandler("toolkit.docker.container.log", Log)
 }
 
 func Exec(ctx context.Context, conf config.Configuration) (err error) {
@@ -39,9 +46,10 @@ func Exec(ctx context.Context, conf config.Configuration) (err error) {
 		return
 	}
 
-	host := conf.GetString("host", "tcp://192.168.99.100:2376")
-	tlsVerify := conf.GetString("tls-verify", "1")
-	certPath := conf.GetString("cert-path")
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
 
 	container := conf.GetString("container")
 
@@ -56,8 +64,18 @@ func Exec(ctx context.Context, conf config.Configuration) (err error) {
 	quiet := conf.GetBoolean("quiet")
 	timeout := conf.GetTimeDuration("timeout")
 
+	allowedExitCodes, err := parseExitCodes(conf.GetStringList("allowed-exit-codes"))
+	if err != nil {
+		return
+	}
+
 	if len(command) == 0 {
-		fmt.Errorf("config of command could not be empty, e.g.: command = [\"/bin/bash\"]")
+		err = fmt.Errorf("config of command could not be empty, e.g.: command = [\"/bin/bash\"]")
+		return
+	}
+
+	secretEnvs, maskedEnvs, err := secret.ResolveEnvironment(ctx, conf.GetConfig("secret-environment"))
+	if err != nil {
 		return
 	}
 
@@ -74,30 +92,28 @@ func Exec(ctx context.Context, conf config.Configuration) (err error) {
 		stdOut = io.MultiWriter(outWriter, os.Stdout)
 	}
 
-	err = os.Setenv("DOCKER_TLS_VERIFY", tlsVerify)
+	cli, err := clientConf.NewClient(goctx.Background())
 	if err != nil {
 		return
 	}
 
-	err = os.Setenv("DOCKER_HOST", host)
-	if err != nil {
-		return
-	}
+	defer cli.Close()
 
-	err = os.Setenv("DOCKER_CERT_PATH", certPath)
-	if err != nil {
-		return
-	}
+	host := clientConf.Host
 
-	docker, err := NewEnvDocker()
+	docker, err := NewDocker(cli)
 	if err != nil {
 		return
 	}
 
 	cmd := Command{
-		Environment: envs,
+		Environment: append(envs[:len(envs):len(envs)], secretEnvs...),
 		Command:     command,
 		Stdin:       stdin,
+		User:        conf.GetString("user"),
+		WorkingDir:  conf.GetString("working-dir"),
+		Privileged:  conf.GetBoolean("privileged", false),
+		Tty:         conf.GetBoolean("tty", false),
 	}
 
 	executor := docker.Attach(container, cmd)
@@ -116,22 +132,35 @@ func Exec(ctx context.Context, conf config.Configuration) (err error) {
 
 	executor.Ctx = c
 
-	err = executor.Exec()
-	if err != nil {
+	start := time.Now()
+
+	errExec := executor.Exec()
+
+	duration := time.Since(start)
+
+	exitErr, isExitErr := errExec.(*ExitError)
+
+	if errExec != nil && !isExitErr {
 		if errWriter.Len() > 0 {
-			err = fmt.Errorf("execute command on docker %s error: %s, details: %s", host, err.Error(), strings.TrimSuffix(errWriter.String(), "\n"))
+			err = fmt.Errorf("execute command on docker %s error: %s, details: %s", host, errExec.Error(), strings.TrimSuffix(errWriter.String(), "\n"))
 			return
 		}
-		err = fmt.Errorf("execute command on docker %s error: %s", host, err.Error())
+		err = fmt.Errorf("execute command on docker %s error: %s", host, errExec.Error())
 		return
 	}
 
 	outputName := conf.GetString("output.name")
 
+	// the secrets are masked in output
+	cmd.Environment = append(envs[:len(envs):len(envs)], maskedEnvs...)
+
 	outputData, err := json.Marshal(OutputValue{
-		Host:    host,
-		Command: cmd,
-		Output:  strings.TrimSuffix(outWriter.String(), "\n"),
+		Host:     host,
+		Command:  cmd,
+		Output:   strings.TrimSuffix(outWriter.String(), "\n"),
+		Stderr:   strings.TrimSuffix(errWriter.String(), "\n"),
+		ExitCode: executor.ExitCode,
+		Duration: duration.String(),
 	})
 
 	if err != nil {
@@ -144,98 +173,43 @@ func Exec(ctx context.Context, conf config.Configuration) (err error) {
 		Tags:  []string{"toolkit", "docker", "exec"},
 	})
 
-	return
-}
-
-func Log(ctx context.Context, conf config.Configuration) (err error) {
-
-	if conf.IsEmpty() {
-		return
-	}
-
-	host := conf.GetString("host", "tcp://192.168.99.100:2376")
-	tlsVerify := conf.GetString("tls-verify", "1")
-	certPath := conf.GetString("cert-path")
-
-	container := conf.GetString("container")
-
-	if len(container) == 0 {
-		err = fmt.Errorf("please input container name or id")
-		return
-	}
-
-	quiet := conf.GetBoolean("quiet")
-	timeout := conf.GetTimeDuration("timeout")
-
-	outWriter := bytes.NewBuffer(nil)
-
-	var stdOut io.Writer
-
-	if quiet {
-		stdOut = outWriter
-	} else {
-		stdOut = io.MultiWriter(outWriter, os.Stdout)
-	}
-
-	err = os.Setenv("DOCKER_TLS_VERIFY", tlsVerify)
-	if err != nil {
-		return
-	}
-
-	err = os.Setenv("DOCKER_HOST", host)
-	if err != nil {
-		return
-	}
-
-	err = os.Setenv("DOCKER_CERT_PATH", certPath)
-	if err != nil {
-		return
-	}
-
-	cli, err := client.NewEnvClient()
-	if err != nil {
+	// the output is kept for the failed command, so the following steps could inspect it
+	if isExitErr && !containsExitCode(allowedExitCodes, exitErr.Code) {
+		if errWriter.Len() > 0 {
+			err = fmt.Errorf("execute command on docker %s error: %s, details: %s", host, exitErr.Error(), strings.TrimSuffix(errWriter.String(), "\n"))
+			return
+		}
+		err = fmt.Errorf("execute command on docker %s error: %s", host, exitErr.Error())
 		return
 	}
 
-	c := goctx.Background()
-
-	if timeout > 0 {
-		var cancel goctx.CancelFunc
-		c, cancel = goctx.WithTimeout(goctx.Background(), timeout)
-		defer cancel()
-	}
-
-	options := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}
-
-	out, err := cli.ContainerLogs(c, container, options)
-
-	if err != nil {
-		return
-	}
+	return
+}
 
-	_, err = io.Copy(stdOut, out)
+// parseExitCodes parses allowed-exit-codes, the default is [0]
+func parseExitCodes(codes []string) (allowed []int, err error) {
 
-	if err != nil {
-		return
+	if len(codes) == 0 {
+		return []int{0}, nil
 	}
 
-	outputName := conf.GetString("output.name")
-
-	if err != nil {
-		return
+	for _, code := range codes {
+		var n int
+		if n, err = strconv.Atoi(strings.TrimSpace(code)); err != nil {
+			err = fmt.Errorf("parse allowed-exit-codes failure: %s", err)
+			return
+		}
+		allowed = append(allowed, n)
 	}
 
-	outputData, err := json.Marshal(map[string]string{"log": outWriter.String()})
+	return
+}
 
-	if err != nil {
-		return
+func containsExitCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
 	}
-
-	flow.AppendOutput(ctx, flow.NameValue{
-		Name:  outputName,
-		Value: outputData,
-		Tags:  []string{"toolkit", "docker", "log"},
-	})
-
-	return
+	return false
 }
@@ -0,0 +1,373 @@
+package docker
+
+import (
+	goctx "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	flow.RegisterHandler("toolkit.docker.image.pull", Pull)
+	flow.RegisterHandler("toolkit.docker.image.push", Push)
+	flow.RegisterHandler("toolkit.docker.image.tag", Tag)
+	flow.RegisterHandler("toolkit.docker.image.remove", RemoveImage)
+}
+
+func Pull(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	image := conf.GetString("image")
+	if len(image) == 0 {
+		err = fmt.Errorf("config of image could not be empty, e.g.: image = \"postgres:10\"")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	if err = pullImage(ctx, c, cli, conf, image); err != nil {
+		err = fmt.Errorf("pull image %s on docker %s failure: %s", image, clientConf.Host, err)
+		return
+	}
+
+	output := &ImageOutput{Host: clientConf.Host}
+
+	if err = inspectImage(c, cli, image, output); err != nil {
+		return
+	}
+
+	logrus.WithField("IMAGE", image).WithField("DIGEST", output.Digest).Infoln("Image pulled")
+
+	return appendImageOutput(ctx, conf, "pull", output)
+}
+
+func Push(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	image := conf.GetString("image")
+	if len(image) == 0 {
+		err = fmt.Errorf("config of image could not be empty, e.g.: image = \"registry.example.com/api:1.2.0\"")
+		return
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		err = fmt.Errorf("parse image %s failure: %s", image, err)
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	auth, err := registryAuth(ctx, conf, image)
+	if err != nil {
+		return
+	}
+
+	// the digest of manifest is sent in aux message after pushed
+	var digest string
+
+	progress := newImageProgress(conf)
+	progress.Aux = func(aux *json.RawMessage) error {
+		result := types.PushResult{}
+		if json.Unmarshal(*aux, &result) == nil && len(result.Digest) > 0 {
+			digest = result.Digest
+		}
+		return nil
+	}
+
+	err = withRetry(c, conf, "push "+image, func() (err error) {
+		reader, err := cli.ImagePush(c, reference.FamiliarString(named), types.ImagePushOptions{RegistryAuth: auth})
+		if err != nil {
+			return
+		}
+		defer reader.Close()
+
+		return progress.Read(reader)
+	})
+
+	if err != nil {
+		err = fmt.Errorf("push image %s on docker %s failure: %s", image, clientConf.Host, err)
+		return
+	}
+
+	output := &ImageOutput{Host: clientConf.Host}
+
+	if err = inspectImage(c, cli, image, output); err != nil {
+		return
+	}
+
+	if len(digest) > 0 {
+		output.Digest = reference.FamiliarName(named) + "@" + digest
+	}
+
+	logrus.WithField("IMAGE", image).WithField("DIGEST", output.Digest).Infoln("Image pushed")
+
+	return appendImageOutput(ctx, conf, "push", output)
+}
+
+func Tag(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	image := conf.GetString("image")
+	tags := conf.GetStringList("tags")
+
+	if len(image) == 0 || len(tags) == 0 {
+		err = fmt.Errorf("config of image and tags could not be empty, e.g.: image = \"example/api:latest\", tags = [\"registry.example.com/api:1.2.0\"]")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	for _, tag := range tags {
+		if err = cli.ImageTag(c, image, tag); err != nil {
+			err = fmt.Errorf("tag image %s as %s on docker %s failure: %s", image, tag, clientConf.Host, err)
+			return
+		}
+	}
+
+	output := &ImageOutput{Host: clientConf.Host}
+
+	if err = inspectImage(c, cli, image, output); err != nil {
+		return
+	}
+
+	logrus.WithField("IMAGE", image).WithField("TAGS", strings.Join(tags, ",")).Infoln("Image tagged")
+
+	return appendImageOutput(ctx, conf, "tag", output)
+}
+
+func RemoveImage(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	image := conf.GetString("image")
+	if len(image) == 0 {
+		err = fmt.Errorf("config of image could not be empty")
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	options := types.ImageRemoveOptions{
+		Force:         conf.GetBoolean("force", false),
+		PruneChildren: conf.GetBoolean("prune", true),
+	}
+
+	_, err = cli.ImageRemove(c, image, options)
+	if err != nil {
+		if client.IsErrNotFound(err) && conf.GetBoolean("ignore-missing", false) {
+			logrus.WithField("IMAGE", image).Infoln("Image not found, skip remove")
+			return nil
+		}
+		err = fmt.Errorf("remove image %s on docker %s failure: %s", image, clientConf.Host, err)
+		return
+	}
+
+	logrus.WithField("IMAGE", image).Infoln("Image removed")
+
+	return appendImageOutput(ctx, conf, "remove", &ImageOutput{Host: clientConf.Host, Tags: []string{image}})
+}
+
+// pullImage pulls the image with the auth and platform of step, the flaky
+// layer downloads are retried
+func pullImage(ctx context.Context, c goctx.Context, cli *client.Client, conf config.Configuration, image string) (err error) {
+
+	auth, err := registryAuth(ctx, conf, image)
+	if err != nil {
+		return
+	}
+
+	options := types.ImagePullOptions{
+		RegistryAuth: auth,
+		Platform:     conf.GetString("platform"),
+	}
+
+	progress := newImageProgress(conf)
+
+	return withRetry(c, conf, "pull "+image, func() (err error) {
+		reader, err := cli.ImagePull(c, image, options)
+		if err != nil {
+			return
+		}
+		defer reader.Close()
+
+		return progress.Read(reader)
+	})
+}
+
+func newImageProgress(conf config.Configuration) *progressStream {
+	var out io.Writer = ioutil.Discard
+	if !conf.GetBoolean("quiet") {
+		out = os.Stdout
+	}
+	return &progressStream{Out: out}
+}
+
+// withRetry retries the action with retries and retry-interval of step, the
+// errors of auth and missing image are not retried
+func withRetry(c goctx.Context, conf config.Configuration, action string, fn func() error) (err error) {
+
+	retries := int(conf.GetInt32("retries", 3))
+	interval := conf.GetTimeDuration("retry-interval", time.Second*2)
+
+	for i := 0; ; i++ {
+		err = fn()
+
+		if err == nil || i >= retries || !isRetryable(err) {
+			return
+		}
+
+		logrus.WithField("ACTION", action).WithField("RETRY", i+1).WithError(err).Warnln("Retrying")
+
+		select {
+		case <-c.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func isRetryable(err error) bool {
+
+	if client.IsErrNotFound(err) {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	for _, permanent := range []string{"unauthorized", "denied", "not found", "manifest unknown", "no such image", "invalid reference"} {
+		if strings.Contains(msg, permanent) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func inspectImage(c goctx.Context, cli *client.Client, image string, output *ImageOutput) (err error) {
+
+	info, _, err := cli.ImageInspectWithRaw(c, image)
+	if err != nil {
+		return
+	}
+
+	output.ID = info.ID
+	output.Tags = info.RepoTags
+	output.Size = info.Size
+
+	if len(info.RepoDigests) == 0 {
+		return
+	}
+
+	output.Digest = info.RepoDigests[0]
+
+	// prefer the digest of the repository of image
+	if named, errParse := reference.ParseNormalizedNamed(image); errParse == nil {
+		prefix := reference.FamiliarName(named) + "@"
+		for _, digest := range info.RepoDigests {
+			if strings.HasPrefix(digest, prefix) {
+				output.Digest = digest
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func appendImageOutput(ctx context.Context, conf config.Configuration, action string, output *ImageOutput) (err error) {
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{
+		Name:  outputName,
+		Value: data,
+		Tags:  []string{"toolkit", "docker", action},
+	})
+
+	return
+}
@@ -0,0 +1,254 @@
+package docker
+
+import (
+	"bytes"
+	goctx "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type LogLine struct {
+	Stream string `json:"stream"`
+	Time   string `json:"time,omitempty"`
+	Line   string `json:"line"`
+}
+
+type LogOutput struct {
+	Host    string    `json:"host"`
+	Log     string    `json:"log"`
+	Lines   []LogLine `json:"lines,omitempty"`
+	Matched string    `json:"matched,omitempty"`
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.docker.container.log", Log)
+}
+
+// Log reads the logs of container, with follow = true the step follows the
+// logs until the container stopped, the until-pattern matched or timeout
+func Log(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	clientConf, err := newClientConfig(conf)
+	if err != nil {
+		return
+	}
+
+	container := conf.GetString("container")
+
+	if len(container) == 0 {
+		err = fmt.Errorf("please input container name or id")
+		return
+	}
+
+	var pattern *regexp.Regexp
+
+	if expr := conf.GetString("until-pattern"); len(expr) > 0 {
+		pattern, err = regexp.Compile(expr)
+		if err != nil {
+			err = fmt.Errorf("compile until-pattern failure: %s", err)
+			return
+		}
+	}
+
+	options := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     conf.GetBoolean("follow", false),
+		Since:      conf.GetString("since"),
+		Until:      conf.GetString("until"),
+		Tail:       conf.GetString("tail", "all"),
+		Timestamps: conf.GetBoolean("timestamps", false),
+	}
+
+	c, cancel := newStepContext(conf)
+	defer cancel()
+
+	cli, err := clientConf.NewClient(c)
+	if err != nil {
+		return
+	}
+
+	defer cli.Close()
+
+	info, err := cli.ContainerInspect(c, container)
+	if err != nil {
+		return
+	}
+
+	// the stream is stopped once the pattern matched
+	streamCtx, stop := goctx.WithCancel(c)
+	defer stop()
+
+	collector := &logCollector{
+		timestamps: options.Timestamps,
+		pattern:    pattern,
+		quiet:      conf.GetBoolean("quiet"),
+		keepLines:  conf.GetBoolean("json-lines", false),
+		stop:       stop,
+	}
+
+	out, err := cli.ContainerLogs(streamCtx, container, options)
+	if err != nil {
+		return
+	}
+
+	defer out.Close()
+
+	stdOut := &logLineWriter{stream: "stdout", emit: collector.Emit}
+	stdErr := &logLineWriter{stream: "stderr", emit: collector.Emit}
+
+	// the logs of tty are not multiplexed
+	if info.Config != nil && info.Config.Tty {
+		_, err = io.Copy(stdOut, out)
+	} else {
+		_, err = stdcopy.StdCopy(stdOut, stdErr, out)
+	}
+
+	stdOut.Flush()
+	stdErr.Flush()
+
+	matched := pattern != nil && collector.matched != nil
+
+	if err != nil && !matched {
+		if c.Err() != nil {
+			err = fmt.Errorf("read logs of container %s failure: %s", container, c.Err())
+			return
+		}
+		err = fmt.Errorf("read logs of container %s failure: %s", container, err)
+		return
+	}
+
+	err = nil
+
+	if pattern != nil && !matched {
+		err = fmt.Errorf("until-pattern %q not found in logs of container %s", pattern.String(), container)
+		return
+	}
+
+	output := LogOutput{
+		Host:  clientConf.Host,
+		Log:   collector.text.String(),
+		Lines: collector.lines,
+	}
+
+	if matched {
+		output.Matched = collector.matched.Line
+		logrus.WithField("CONTAINER", container).WithField("LINE", output.Matched).Infoln("Log pattern matched")
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	outputData, err := json.Marshal(output)
+
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{
+		Name:  outputName,
+		Value: outputData,
+		Tags:  []string{"toolkit", "docker", "log"},
+	})
+
+	return
+}
+
+// logLineWriter splits the stream into lines
+type logLineWriter struct {
+	stream string
+	buf    []byte
+	emit   func(stream, line string)
+}
+
+func (p *logLineWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		p.emit(p.stream, strings.TrimSuffix(string(p.buf[:i]), "\r"))
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(b), nil
+}
+
+// Flush emits the last line without newline
+func (p *logLineWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.emit(p.stream, strings.TrimSuffix(string(p.buf), "\r"))
+		p.buf = nil
+	}
+}
+
+// logCollector keeps the lines until the pattern matched, the lines are
+// emitted by the copying goroutine only, so there is no lock
+type logCollector struct {
+	timestamps bool
+	pattern    *regexp.Regexp
+	quiet      bool
+	keepLines  bool
+	stop       func()
+
+	text    bytes.Buffer
+	lines   []LogLine
+	matched *LogLine
+}
+
+func (p *logCollector) Emit(stream, text string) {
+
+	if p.matched != nil {
+		return
+	}
+
+	line := LogLine{Stream: stream, Line: text}
+
+	// 2018-05-30T08:12:51.123456789Z message
+	if p.timestamps {
+		if i := strings.IndexByte(text, ' '); i > 0 {
+			line.Time, line.Line = text[:i], text[i+1:]
+		}
+	}
+
+	p.text.WriteString(text)
+	p.text.WriteByte('\n')
+
+	if p.keepLines {
+		p.lines = append(p.lines, line)
+	}
+
+	if !p.quiet {
+		if stream == "stderr" {
+			fmt.Fprintln(os.Stderr, text)
+		} else {
+			fmt.Fprintln(os.Stdout, text)
+		}
+	}
+
+	if p.pattern != nil && p.pattern.MatchString(line.Line) {
+		p.matched = &line
+		p.stop()
+	}
+}
@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// progressStream renders the json message stream of image build, pull and
+// push as plain lines, the progress bars are reduced to the status changes
+// of each layer, so the logs are readable without terminal
+type progressStream struct {
+	Out io.Writer
+	Aux func(*json.RawMessage) error
+
+	// Step is the last `Step n/m : INSTRUCTION` of build
+	Step string
+
+	status map[string]string
+}
+
+func (p *progressStream) Read(body io.Reader) (err error) {
+
+	p.status = map[string]string{}
+
+	decoder := json.NewDecoder(body)
+
+	for {
+		msg := jsonmessage.JSONMessage{}
+
+		if err = decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("decode progress failure: %s", err)
+		}
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if len(msg.ErrorMessage) > 0 {
+			return fmt.Errorf("%s", msg.ErrorMessage)
+		}
+
+		if msg.Aux != nil && p.Aux != nil {
+			if err = p.Aux(msg.Aux); err != nil {
+				return
+			}
+		}
+
+		if len(msg.Stream) > 0 {
+			for _, line := range strings.Split(strings.TrimRight(msg.Stream, "\n"), "\n") {
+				if strings.HasPrefix(line, "Step ") {
+					p.Step = line
+				}
+			}
+			p.write(msg.Stream)
+			continue
+		}
+
+		if len(msg.Status) == 0 {
+			continue
+		}
+
+		if len(msg.ID) == 0 {
+			p.write(msg.Status + "\n")
+			continue
+		}
+
+		if p.status[msg.ID] == msg.Status {
+			continue
+		}
+
+		p.status[msg.ID] = msg.Status
+
+		p.write(msg.ID + ": " + msg.Status + "\n")
+	}
+}
+
+func (p *progressStream) write(s string) {
+	if p.Out != nil {
+		io.WriteString(p.Out, s)
+	}
+}
@@ -0,0 +1,311 @@
+package pwgen
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type sqlCheck struct {
+	Name   string
+	SQL    string
+	Args   []interface{}
+	Expect checkExpect
+}
+
+// checkExpect is the expectation of check, empty means unset
+type checkExpect struct {
+	Equals string
+	LT     string
+	GT     string
+	Rows   string
+	Empty  string
+	Regex  string
+}
+
+type CheckResult struct {
+	Name    string      `json:"name"`
+	Passed  bool        `json:"passed"`
+	Rows    int         `json:"rows"`
+	Value   interface{} `json:"value"`
+	Message string      `json:"message,omitempty"`
+}
+
+type AssertOutput struct {
+	Passed   bool          `json:"passed"`
+	Attempts int           `json:"attempts"`
+	Checks   []CheckResult `json:"checks"`
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.assert", Assert)
+}
+
+func Assert(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	checks, err := loadChecks(conf, driver)
+	if err != nil {
+		return
+	}
+
+	if len(checks) == 0 {
+		err = fmt.Errorf("config of checks could not be empty")
+		return
+	}
+
+	interval := conf.GetTimeDuration("interval", time.Second*3)
+	// the same as toolkit.monitor.http, 0 or unset retries until the checks pass
+	times := int(conf.GetInt32("times", 0))
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	output := AssertOutput{}
+
+	for times == 0 || output.Attempts < times {
+
+		output.Attempts++
+		output.Passed = true
+		output.Checks = nil
+
+		for _, check := range checks {
+			result := runCheck(db, check)
+			output.Checks = append(output.Checks, result)
+
+			if !result.Passed {
+				output.Passed = false
+				logrus.WithField("CHECK", check.Name).WithField("CONTENT", result.Message).Infoln("Checking sql assertion failure")
+			}
+		}
+
+		if output.Passed {
+			logrus.WithField("ATTEMPTS", output.Attempts).Infoln("Checking sql assertions success")
+			break
+		}
+
+		if times == 0 || output.Attempts < times {
+			time.Sleep(interval)
+		}
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) > 0 {
+		var data []byte
+		data, err = json.Marshal(output)
+		if err != nil {
+			return
+		}
+
+		flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+	}
+
+	if !output.Passed {
+		var failures []string
+		for _, result := range output.Checks {
+			if !result.Passed {
+				failures = append(failures, fmt.Sprintf("%s: %s", result.Name, result.Message))
+			}
+		}
+		err = fmt.Errorf("sql assertions failed after %d attempts:\n%s", output.Attempts, strings.Join(failures, "\n"))
+		return
+	}
+
+	return
+}
+
+func loadChecks(conf config.Configuration, driver sqlDriver) (checks []sqlCheck, err error) {
+
+	checksConf := conf.GetConfig("checks")
+
+	if checksConf.IsEmpty() {
+		return
+	}
+
+	names := checksConf.Keys()
+	sort.Strings(names)
+
+	for _, name := range names {
+		checkConf := checksConf.GetConfig(name)
+
+		if checkConf.IsEmpty() {
+			continue
+		}
+
+		check := sqlCheck{
+			Name: name,
+			Expect: checkExpect{
+				Equals: checkConf.GetString("equals"),
+				LT:     checkConf.GetString("lt"),
+				GT:     checkConf.GetString("gt"),
+				Rows:   checkConf.GetString("rows"),
+				Empty:  checkConf.GetString("empty"),
+				Regex:  checkConf.GetString("regex"),
+			},
+		}
+
+		check.SQL, err = renderSQL(checkConf.GetString("sql"), conf.GetConfig("variables"), driver.Dialect)
+		if err != nil {
+			return
+		}
+
+		if len(strings.TrimSpace(check.SQL)) == 0 {
+			err = fmt.Errorf("config of sql could not be empty, check: %s", name)
+			return
+		}
+
+		params := newSQLParams(checkConf)
+
+		check.SQL, check.Args, err = params.Bind(check.SQL, driver)
+		if err != nil {
+			return
+		}
+
+		if err = params.Done(); err != nil {
+			return
+		}
+
+		checks = append(checks, check)
+	}
+
+	return
+}
+
+func runCheck(db *sql.DB, check sqlCheck) (result CheckResult) {
+
+	result.Name = check.Name
+
+	queryResult, err := queryAll(db, "original", check.SQL, check.Args...)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+
+	result.Rows = len(queryResult.Rows)
+
+	var value interface{}
+	if result.Rows > 0 && len(queryResult.Columns) > 0 {
+		value = queryResult.Rows[0][0]
+	}
+
+	result.Value = value
+
+	err = check.Expect.Check(result.Rows, value)
+	if err != nil {
+		result.Message = err.Error()
+		return
+	}
+
+	result.Passed = true
+
+	return
+}
+
+func (p checkExpect) Check(rows int, value interface{}) (err error) {
+
+	if len(p.Rows) > 0 {
+		var expect int
+		expect, err = strconv.Atoi(p.Rows)
+		if err != nil {
+			return
+		}
+
+		if rows != expect {
+			return fmt.Errorf("expect %d rows, but got %d", expect, rows)
+		}
+	}
+
+	if len(p.Empty) > 0 {
+		var empty bool
+		empty, err = strconv.ParseBool(p.Empty)
+		if err != nil {
+			return
+		}
+
+		if empty && rows > 0 {
+			return fmt.Errorf("expect empty, but got %d rows", rows)
+		}
+
+		if !empty && rows == 0 {
+			return fmt.Errorf("expect non-empty, but got no rows")
+		}
+	}
+
+	text := formatTextValue(value)
+
+	if len(p.Equals) > 0 {
+		if cmp, ok := compareNumber(text, p.Equals); (ok && cmp != 0) || (!ok && text != p.Equals) {
+			return fmt.Errorf("expect value equals %s, but got %s", p.Equals, text)
+		}
+	}
+
+	if len(p.LT) > 0 {
+		if cmp, ok := compareNumber(text, p.LT); !ok || cmp >= 0 {
+			return fmt.Errorf("expect value < %s, but got %s", p.LT, text)
+		}
+	}
+
+	if len(p.GT) > 0 {
+		if cmp, ok := compareNumber(text, p.GT); !ok || cmp <= 0 {
+			return fmt.Errorf("expect value > %s, but got %s", p.GT, text)
+		}
+	}
+
+	if len(p.Regex) > 0 {
+		var matched bool
+		matched, err = regexp.MatchString(p.Regex, text)
+		if err != nil {
+			return
+		}
+
+		if !matched {
+			return fmt.Errorf("expect value matches %s, but got %s", p.Regex, text)
+		}
+	}
+
+	return
+}
+
+func compareNumber(a, b string) (int, bool) {
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+
+	return 0, true
+}
@@ -0,0 +1,118 @@
+package pwgen
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gogap/config"
+)
+
+type sqlConfig struct {
+	Driver   string
+	DSN      string
+	User     string
+	Password string
+	Host     string
+	Port     int
+	Db       string
+	Charset  string
+	Location string
+
+	// postgres
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// mysql
+	TLS       string
+	ParseTime bool
+
+	Timeout      time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	ConnectTimeout       time.Duration
+	ConnectRetries       int
+	ConnectRetryInterval time.Duration
+	MaxOpenConns         int
+	MaxIdleConns         int
+	ConnMaxLifetime      time.Duration
+
+	// the password is resolved on connecting, see secret.Resolve
+	conf config.Configuration
+}
+
+func newSQLConfig(conf config.Configuration) *sqlConfig {
+	return &sqlConfig{
+		Driver:       conf.GetString("driver", "mysql"),
+		DSN:          conf.GetString("dsn"),
+		Host:         conf.GetString("host", "localhost"),
+		Port:         int(conf.GetInt32("port", 0)),
+		Db:           conf.GetString("db"),
+		User:         conf.GetString("user"),
+		Charset:      conf.GetString("charset", "utf8"),
+		Location:     conf.GetString("loc"),
+		SSLMode:      conf.GetString("sslmode", "disable"),
+		SSLRootCert:  conf.GetString("sslrootcert"),
+		SSLCert:      conf.GetString("sslcert"),
+		SSLKey:       conf.GetString("sslkey"),
+		TLS:          conf.GetString("tls"),
+		ParseTime:    conf.GetBoolean("parse-time", false),
+		Timeout:      conf.GetTimeDuration("timeout", 0),
+		ReadTimeout:  conf.GetTimeDuration("read-timeout", 0),
+		WriteTimeout: conf.GetTimeDuration("write-timeout", 0),
+
+		ConnectTimeout:       conf.GetTimeDuration("connect-timeout", time.Second*10),
+		ConnectRetries:       int(conf.GetInt32("connect-retries", 0)),
+		ConnectRetryInterval: conf.GetTimeDuration("connect-retry-interval", time.Second),
+		MaxOpenConns:         int(conf.GetInt32("max-open-conns", 0)),
+		MaxIdleConns:         int(conf.GetInt32("max-idle-conns", 2)),
+		ConnMaxLifetime:      conf.GetTimeDuration("conn-max-lifetime", 0),
+
+		conf: conf,
+	}
+}
+
+func (p *sqlConfig) driver() (sqlDriver, error) {
+	driver, exist := drivers[p.Driver]
+	if !exist {
+		return sqlDriver{}, fmt.Errorf("unsupported sql driver: %s", p.Driver)
+	}
+
+	return driver, nil
+}
+
+// DriverName returns the name registered to database/sql by the driver package
+func (p *sqlConfig) DriverName() (string, error) {
+	driver, err := p.driver()
+	if err != nil {
+		return "", err
+	}
+
+	return driver.Name, nil
+}
+
+// DataSourceName returns the raw dsn if it was configured, otherwise build it by driver
+func (p *sqlConfig) DataSourceName() (string, error) {
+	driver, err := p.driver()
+	if err != nil {
+		return "", err
+	}
+
+	if len(p.DSN) > 0 {
+		return p.DSN, nil
+	}
+
+	conf := *p
+
+	if conf.Port == 0 {
+		conf.Port = driver.DefaultPort
+	}
+
+	if len(conf.User) == 0 {
+		conf.User = driver.DefaultUser
+	}
+
+	return driver.DSN(&conf)
+}
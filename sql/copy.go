@@ -0,0 +1,356 @@
+package pwgen
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type CopyOutput struct {
+	Tables []ImportOutput `json:"tables"`
+}
+
+// maskRule replaces the value of column before it is written to destination
+type maskRule struct {
+	Kind     string
+	Constant string
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.copy", Copy)
+}
+
+func Copy(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	srcConf := conf.GetConfig("source")
+	dstConf := conf.GetConfig("destination")
+
+	if srcConf.IsEmpty() || dstConf.IsEmpty() {
+		err = fmt.Errorf("config of source and destination could not be empty")
+		return
+	}
+
+	srcSQLConf := newSQLConfig(srcConf)
+	dstSQLConf := newSQLConfig(dstConf)
+
+	srcDriver, err := srcSQLConf.driver()
+	if err != nil {
+		return
+	}
+
+	dstDriver, err := dstSQLConf.driver()
+	if err != nil {
+		return
+	}
+
+	tables := conf.GetStringList("tables")
+	if len(tables) == 0 {
+		err = fmt.Errorf("config of tables could not be empty")
+		return
+	}
+
+	srcDB, err := srcSQLConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	dstDB, err := dstSQLConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	salt := conf.GetString("mask-salt")
+	truncate := conf.GetBoolean("truncate", false)
+
+	tablesConf := conf.GetConfig("table")
+
+	// the config of unknown table, e.g. the unquoted public.users, would copy the table unmasked
+	if err = checkTableKeys(tablesConf, "table", tables); err != nil {
+		return
+	}
+
+	output := CopyOutput{}
+
+	for _, table := range tables {
+		tableConf := tablesConf.GetConfig(quoteConfigKey(table))
+
+		// the options of import are shared by all tables, e.g.: batch-size, on-conflict, method,
+		// the columns are configured per table
+		var opts importOptions
+		opts, err = newImportOptions(conf, dstDriver)
+		if err != nil {
+			return
+		}
+
+		opts.Table = table
+
+		if !tableConf.IsEmpty() {
+			opts.Table = tableConf.GetString("target", table)
+
+			// columns { target = "source column" }
+			if columnsConf := tableConf.GetConfig("columns"); !columnsConf.IsEmpty() {
+				opts.Columns = columnsConf.Keys()
+				sort.Strings(opts.Columns)
+
+				for _, column := range opts.Columns {
+					opts.Sources = append(opts.Sources, columnsConf.GetString(column, column))
+				}
+			}
+		}
+
+		var masks map[string]maskRule
+		masks, err = newMaskRules(tableConf.GetConfig("mask"))
+		if err != nil {
+			err = fmt.Errorf("table %s: %s", table, err)
+			return
+		}
+
+		if err = checkMaskSalt(masks, salt); err != nil {
+			err = fmt.Errorf("table %s: %s", table, err)
+			return
+		}
+
+		opts.Truncate = truncate
+
+		query := "SELECT * FROM " + srcDriver.Dialect.QuoteIdentifier(table)
+		if where := tableConf.GetString("where"); len(where) > 0 {
+			query += " WHERE " + where
+		}
+
+		var result *ImportOutput
+		result, err = copyTable(srcDB, dstDB, dstDriver, opts, query, masks, salt)
+		if err != nil {
+			err = fmt.Errorf("copy table %s failure: %s", table, err)
+			return
+		}
+
+		logrus.WithField("SOURCE", table).WithField("TARGET", opts.Table).WithField("ROWS", result.Rows).Infoln("Copy table success")
+
+		output.Tables = append(output.Tables, *result)
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+
+	return
+}
+
+func copyTable(srcDB, dstDB *sql.DB, dstDriver sqlDriver, opts importOptions, query string, masks map[string]maskRule, salt string) (output *ImportOutput, err error) {
+
+	rows, err := srcDB.Query(query)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	reader, err := newRowsRecordReader(rows, masks, salt)
+	if err != nil {
+		return
+	}
+
+	for column := range masks {
+		if !reader.hasField(column) {
+			err = fmt.Errorf("mask column %s not found", column)
+			return
+		}
+	}
+
+	if len(opts.Columns) == 0 {
+		opts.Columns = reader.Fields()
+		opts.Sources = opts.Columns
+	}
+
+	imp := &importer{
+		driver: dstDriver,
+		opts:   opts,
+		reader: reader,
+		output: &ImportOutput{Table: opts.Table},
+	}
+
+	if err = imp.run(dstDB); err != nil {
+		return
+	}
+
+	return imp.output, nil
+}
+
+func newMaskRules(conf config.Configuration) (rules map[string]maskRule, err error) {
+
+	rules = map[string]maskRule{}
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	for _, column := range conf.Keys() {
+
+		// note { constant = "redacted" }
+		if constConf := conf.GetConfig(column); !constConf.IsEmpty() {
+			rules[column] = maskRule{Kind: "constant", Constant: constConf.GetString("constant")}
+			continue
+		}
+
+		kind := conf.GetString(column)
+
+		switch kind {
+		case "hash", "null", "email":
+		default:
+			err = fmt.Errorf("unknown mask of column %s: %s, should be one of hash, null, email or { constant = \"...\" }", column, kind)
+			return
+		}
+
+		rules[column] = maskRule{Kind: kind}
+	}
+
+	return
+}
+
+// checkMaskSalt requires the salt for hash and email masks, the hash without
+// salt could be reversed by hashing the guessed values
+func checkMaskSalt(masks map[string]maskRule, salt string) error {
+
+	if len(salt) > 0 {
+		return nil
+	}
+
+	columns := make([]string, 0, len(masks))
+	for column := range masks {
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+
+	for _, column := range columns {
+		if kind := masks[column].Kind; kind == "hash" || kind == "email" {
+			return fmt.Errorf("mask %s of column %s requires mask-salt", kind, column)
+		}
+	}
+
+	return nil
+}
+
+// Apply masks the value, the hash is stable, so the masked values are still
+// unique and could be joined
+func (p maskRule) Apply(v interface{}, salt string) interface{} {
+
+	if v == nil && p.Kind != "constant" {
+		return nil
+	}
+
+	switch p.Kind {
+	case "null":
+		return nil
+	case "constant":
+		return p.Constant
+	}
+
+	sum := fmt.Sprintf("%0x", sha256.Sum256([]byte(salt+formatTextValue(v))))
+
+	if p.Kind == "email" {
+		return "user-" + sum[:16] + "@example.com"
+	}
+
+	return sum
+}
+
+// rowsRecordReader reads the records from query, the values are kept as
+// scanned, except the text is converted to string
+type rowsRecordReader struct {
+	rows   *sql.Rows
+	fields []string
+	binary []bool
+	masks  map[string]maskRule
+	salt   string
+}
+
+func newRowsRecordReader(rows *sql.Rows, masks map[string]maskRule, salt string) (*rowsRecordReader, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &rowsRecordReader{rows: rows, masks: masks, salt: salt}
+
+	for _, columnType := range columnTypes {
+		dbType := strings.ToUpper(columnType.DatabaseTypeName())
+
+		reader.fields = append(reader.fields, columnType.Name())
+		reader.binary = append(reader.binary, strings.Contains(dbType, "BLOB") || strings.Contains(dbType, "BINARY") || dbType == "BYTEA")
+	}
+
+	return reader, nil
+}
+
+func (p *rowsRecordReader) Fields() []string {
+	return p.fields
+}
+
+func (p *rowsRecordReader) hasField(name string) bool {
+	for _, field := range p.fields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *rowsRecordReader) Read() (map[string]interface{}, error) {
+	if !p.rows.Next() {
+		if err := p.rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	values := make([]interface{}, len(p.fields))
+	ptrs := make([]interface{}, len(p.fields))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	if err := p.rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	record := make(map[string]interface{}, len(values))
+
+	for i, field := range p.fields {
+		v := values[i]
+
+		if b, ok := v.([]byte); ok && !p.binary[i] {
+			v = string(b)
+		}
+
+		if mask, exist := p.masks[field]; exist {
+			v = mask.Apply(v, p.salt)
+		}
+
+		record[field] = v
+	}
+
+	return record, nil
+}
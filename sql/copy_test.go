@@ -0,0 +1,62 @@
+package pwgen
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func TestMaskRuleApply(t *testing.T) {
+
+	salt := "s3cret"
+	sum := fmt.Sprintf("%0x", sha256.Sum256([]byte(salt+"alice@example.org")))
+
+	cases := []struct {
+		name     string
+		rule     maskRule
+		value    interface{}
+		expected interface{}
+	}{
+		{name: "null", rule: maskRule{Kind: "null"}, value: "alice", expected: nil},
+		{name: "constant", rule: maskRule{Kind: "constant", Constant: "redacted"}, value: "alice", expected: "redacted"},
+		{name: "constant of null", rule: maskRule{Kind: "constant", Constant: "redacted"}, value: nil, expected: "redacted"},
+		{name: "hash", rule: maskRule{Kind: "hash"}, value: "alice@example.org", expected: sum},
+		{name: "hash of null", rule: maskRule{Kind: "hash"}, value: nil, expected: nil},
+		{name: "hash of number", rule: maskRule{Kind: "hash"}, value: 42, expected: fmt.Sprintf("%0x", sha256.Sum256([]byte(salt+"42")))},
+		{name: "email", rule: maskRule{Kind: "email"}, value: "alice@example.org", expected: "user-" + sum[:16] + "@example.com"},
+	}
+
+	for _, c := range cases {
+		if v := c.rule.Apply(c.value, salt); v != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, v)
+		}
+	}
+
+	// the salt changes the hash
+	if a, b := (maskRule{Kind: "hash"}).Apply("alice", "a"), (maskRule{Kind: "hash"}).Apply("alice", "b"); a == b {
+		t.Errorf("hash: expected different values of different salts, got %v", a)
+	}
+}
+
+func TestCheckMaskSalt(t *testing.T) {
+
+	cases := []struct {
+		name    string
+		masks   map[string]maskRule
+		salt    string
+		invalid bool
+	}{
+		{name: "no masks", masks: map[string]maskRule{}},
+		{name: "null and constant", masks: map[string]maskRule{"phone": {Kind: "null"}, "note": {Kind: "constant"}}},
+		{name: "hash without salt", masks: map[string]maskRule{"name": {Kind: "hash"}}, invalid: true},
+		{name: "email without salt", masks: map[string]maskRule{"email": {Kind: "email"}}, invalid: true},
+		{name: "hash with salt", masks: map[string]maskRule{"name": {Kind: "hash"}, "email": {Kind: "email"}}, salt: "s3cret"},
+	}
+
+	for _, c := range cases {
+		err := checkMaskSalt(c.masks, c.salt)
+		if (err != nil) != c.invalid {
+			t.Errorf("%s: expected invalid %t, got %v", c.name, c.invalid, err)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package pwgen
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dsnBuilder func(p *sqlConfig) (string, error)
+
+// placeholderFunc returns the bind variable of the i-th (start from 1) parameter
+type placeholderFunc func(i int) string
+
+// sessionSettings returns the statements to apply timeouts on session, local
+// means the settings only affect the current transaction
+type sessionSettings func(statementTimeout, lockTimeout time.Duration, local bool) []string
+
+type sqlDriver struct {
+	Name        string
+	DefaultPort int
+	DefaultUser string
+	DSN         dsnBuilder
+	Dialect     sqlDialect
+	Placeholder placeholderFunc
+	Settings    sessionSettings
+	// the statements to restore the session settings
+	ResetSettings []string
+	// the error codes of serialization failure or deadlock, the transaction could be retried,
+	// e.g.: Number of *mysql.MySQLError or mssql.Error, Code (SQLSTATE) of *pq.Error
+	RetryableCodes []string
+	// the messages of them, for the drivers without error code
+	RetryableErrors []string
+}
+
+var (
+	mysqlDriver = sqlDriver{
+		Name:            "mysql",
+		DefaultPort:     3306,
+		DefaultUser:     "root",
+		DSN:             mysqlDSN,
+		Dialect:         mysqlDialect,
+		Placeholder:     questionPlaceholder,
+		Settings:        mysqlSettings,
+		ResetSettings:   []string{"SET SESSION max_execution_time = DEFAULT", "SET SESSION innodb_lock_wait_timeout = DEFAULT"},
+		RetryableCodes:  []string{"1213", "1205"},
+		RetryableErrors: []string{"Error 1213", "Error 1205"},
+	}
+
+	postgresDriver = sqlDriver{
+		Name:            "postgres",
+		DefaultPort:     5432,
+		DefaultUser:     "postgres",
+		DSN:             postgresDSN,
+		Dialect:         postgresDialect,
+		Placeholder:     dollarPlaceholder,
+		Settings:        postgresSettings,
+		ResetSettings:   []string{"RESET statement_timeout", "RESET lock_timeout"},
+		RetryableCodes:  []string{"40001", "40P01"},
+		RetryableErrors: []string{"could not serialize access", "deadlock detected"},
+	}
+
+	sqliteDriver = sqlDriver{
+		Name:            "sqlite3",
+		DSN:             sqliteDSN,
+		Dialect:         genericDialect,
+		Placeholder:     questionPlaceholder,
+		RetryableErrors: []string{"database is locked"},
+	}
+
+	mssqlDriver = sqlDriver{
+		Name:            "sqlserver",
+		DefaultPort:     1433,
+		DefaultUser:     "sa",
+		DSN:             mssqlDSN,
+		Dialect:         genericDialect,
+		Placeholder:     atPlaceholder,
+		Settings:        mssqlSettings,
+		ResetSettings:   []string{"SET LOCK_TIMEOUT -1"},
+		RetryableCodes:  []string{"1205", "3960"},
+		RetryableErrors: []string{"was deadlocked on lock resources", "Snapshot isolation transaction aborted due to update conflict"},
+	}
+
+	clickhouseDriver = sqlDriver{
+		Name:        "clickhouse",
+		DefaultPort: 9000,
+		DefaultUser: "default",
+		DSN:         clickhouseDSN,
+		Dialect:     clickhouseDialect,
+		Placeholder: questionPlaceholder,
+	}
+)
+
+// drivers is keyed by the value of config 'driver', the driver package itself
+// still needs to be imported, e.g.: packages = ["github.com/lib/pq"]
+var drivers = map[string]sqlDriver{
+	"mysql":      mysqlDriver,
+	"postgres":   postgresDriver,
+	"sqlite":     sqliteDriver,
+	"sqlite3":    sqliteDriver,
+	"mssql":      mssqlDriver,
+	"sqlserver":  mssqlDriver,
+	"clickhouse": clickhouseDriver,
+}
+
+func (p sqlDriver) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if code := errorCode(err); len(code) > 0 {
+		return containsString(p.RetryableCodes, code)
+	}
+
+	for _, msg := range p.RetryableErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorCode reads the code of driver error, the driver packages are loaded by
+// config, so the fields are read by reflection: Number of mysql and mssql,
+// Code of postgres, it is empty for the other errors
+func errorCode(err error) string {
+
+	if stmtErr, ok := err.(*statementError); ok {
+		err = stmtErr.Err
+	}
+
+	v := reflect.ValueOf(err)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	if f := v.FieldByName("Number"); f.IsValid() {
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(f.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return strconv.FormatUint(f.Uint(), 10)
+		}
+	}
+
+	if f := v.FieldByName("Code"); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+
+	return ""
+}
+
+func (p sqlDriver) SessionSettings(statementTimeout, lockTimeout time.Duration, local bool) []string {
+	if p.Settings == nil {
+		return nil
+	}
+
+	return p.Settings(statementTimeout, lockTimeout, local)
+}
+
+func mysqlSettings(statementTimeout, lockTimeout time.Duration, local bool) (settings []string) {
+	// mysql has no transaction scoped variables
+	if statementTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("SET SESSION max_execution_time = %d", statementTimeout/time.Millisecond))
+	}
+
+	if lockTimeout > 0 {
+		seconds := int64(math.Ceil(lockTimeout.Seconds()))
+		settings = append(settings, fmt.Sprintf("SET SESSION innodb_lock_wait_timeout = %d", seconds))
+	}
+
+	return
+}
+
+func postgresSettings(statementTimeout, lockTimeout time.Duration, local bool) (settings []string) {
+	scope := "SESSION"
+	if local {
+		scope = "LOCAL"
+	}
+
+	if statementTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("SET %s statement_timeout = %d", scope, statementTimeout/time.Millisecond))
+	}
+
+	if lockTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("SET %s lock_timeout = %d", scope, lockTimeout/time.Millisecond))
+	}
+
+	return
+}
+
+func mssqlSettings(statementTimeout, lockTimeout time.Duration, local bool) (settings []string) {
+	if lockTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("SET LOCK_TIMEOUT %d", lockTimeout/time.Millisecond))
+	}
+
+	return
+}
+
+func questionPlaceholder(int) string {
+	return "?"
+}
+
+func dollarPlaceholder(i int) string {
+	return "$" + strconv.Itoa(i)
+}
+
+func atPlaceholder(i int) string {
+	return "@p" + strconv.Itoa(i)
+}
+
+func mysqlDSN(p *sqlConfig) (string, error) {
+	params := url.Values{}
+
+	params.Set("charset", p.Charset)
+
+	if len(p.Location) > 0 {
+		params.Set("loc", p.Location)
+	}
+
+	if len(p.TLS) > 0 {
+		params.Set("tls", p.TLS)
+	}
+
+	if p.ParseTime {
+		params.Set("parseTime", "true")
+	}
+
+	if p.Timeout > 0 {
+		params.Set("timeout", p.Timeout.String())
+	}
+
+	if p.ReadTimeout > 0 {
+		params.Set("readTimeout", p.ReadTimeout.String())
+	}
+
+	if p.WriteTimeout > 0 {
+		params.Set("writeTimeout", p.WriteTimeout.String())
+	}
+
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?%s", p.User, p.Password, p.Host, p.Port, p.Db, params.Encode()), nil
+}
+
+func postgresDSN(p *sqlConfig) (string, error) {
+	db := p.Db
+	if len(db) == 0 {
+		db = "postgres"
+	}
+
+	items := []string{
+		"host=" + quotePostgresValue(p.Host),
+		"port=" + strconv.Itoa(p.Port),
+		"user=" + quotePostgresValue(p.User),
+		"password=" + quotePostgresValue(p.Password),
+		"dbname=" + quotePostgresValue(db),
+		"sslmode=" + quotePostgresValue(p.SSLMode),
+	}
+
+	if len(p.SSLRootCert) > 0 {
+		items = append(items, "sslrootcert="+quotePostgresValue(p.SSLRootCert))
+	}
+
+	if len(p.SSLCert) > 0 {
+		items = append(items, "sslcert="+quotePostgresValue(p.SSLCert))
+	}
+
+	if len(p.SSLKey) > 0 {
+		items = append(items, "sslkey="+quotePostgresValue(p.SSLKey))
+	}
+
+	if p.Timeout > 0 {
+		items = append(items, "connect_timeout="+strconv.Itoa(int(p.Timeout.Seconds())))
+	}
+
+	return strings.Join(items, " "), nil
+}
+
+func quotePostgresValue(v string) string {
+	if len(v) > 0 && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `'`, `\'`, -1)
+
+	return "'" + v + "'"
+}
+
+func sqliteDSN(p *sqlConfig) (string, error) {
+	if len(p.Db) == 0 {
+		return "", fmt.Errorf("config of db could not be empty for sqlite, e.g.: db = \"/tmp/test.db\"")
+	}
+
+	return p.Db, nil
+}
+
+func mssqlDSN(p *sqlConfig) (string, error) {
+	params := url.Values{}
+
+	if len(p.Db) > 0 {
+		params.Set("database", p.Db)
+	}
+
+	if p.Timeout > 0 {
+		params.Set("connection timeout", strconv.Itoa(int(p.Timeout.Seconds())))
+	}
+
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(p.User, p.Password),
+		Host:     fmt.Sprintf("%s:%d", p.Host, p.Port),
+		RawQuery: params.Encode(),
+	}
+
+	return u.String(), nil
+}
+
+func clickhouseDSN(p *sqlConfig) (string, error) {
+	params := url.Values{}
+
+	params.Set("username", p.User)
+	params.Set("password", p.Password)
+
+	if len(p.Db) > 0 {
+		params.Set("database", p.Db)
+	}
+
+	if p.ReadTimeout > 0 {
+		params.Set("read_timeout", strconv.Itoa(int(p.ReadTimeout.Seconds())))
+	}
+
+	if p.WriteTimeout > 0 {
+		params.Set("write_timeout", strconv.Itoa(int(p.WriteTimeout.Seconds())))
+	}
+
+	u := url.URL{
+		Scheme:   "tcp",
+		Host:     fmt.Sprintf("%s:%d", p.Host, p.Port),
+		RawQuery: params.Encode(),
+	}
+
+	return u.String(), nil
+}
@@ -0,0 +1,755 @@
+package pwgen
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	goctx "context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type DumpTable struct {
+	Name  string `json:"name"`
+	Where string `json:"where,omitempty"`
+	Rows  int64  `json:"rows"`
+}
+
+type DumpOutput struct {
+	File   string      `json:"file"`
+	SHA256 string      `json:"sha256"`
+	Size   int64       `json:"size"`
+	Tables []DumpTable `json:"tables"`
+}
+
+type RestoreOutput struct {
+	File         string `json:"file"`
+	SHA256       string `json:"sha256"`
+	Statements   int    `json:"statements"`
+	RowsAffected int64  `json:"rows_affected"`
+}
+
+type countWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (p *countWriter) Write(b []byte) (n int, err error) {
+	n, err = p.w.Write(b)
+	p.written += int64(n)
+	return
+}
+
+type dumper struct {
+	db        *sql.DB
+	driver    sqlDriver
+	w         *bufio.Writer
+	schema    bool
+	data      bool
+	drop      bool
+	batchSize int
+
+	// the foreign keys of postgres, added after all tables
+	foreignKeys []string
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.dump", Dump)
+	flow.RegisterHandler("toolkit.sql.restore", Restore)
+}
+
+func Dump(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	file := conf.GetString("file")
+	if len(file) == 0 {
+		err = fmt.Errorf("config of file could not be empty, e.g.: file = \"/backup/test.sql.gz\"")
+		return
+	}
+
+	tableNames := conf.GetStringList("tables")
+	if len(tableNames) == 0 {
+		err = fmt.Errorf("config of tables could not be empty, e.g.: tables = [\"user\"]")
+		return
+	}
+
+	whereConf := conf.GetConfig("where")
+
+	if err = checkTableKeys(whereConf, "where", tableNames); err != nil {
+		return
+	}
+
+	var tables []DumpTable
+	for _, name := range tableNames {
+		table := DumpTable{Name: name}
+		if !whereConf.IsEmpty() {
+			table.Where = whereConf.GetString(quoteConfigKey(name))
+		}
+		tables = append(tables, table)
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	hasher := sha256.New()
+	counter := &countWriter{w: io.MultiWriter(f, hasher)}
+
+	var out io.Writer = counter
+	var gz *gzip.Writer
+
+	if conf.GetBoolean("gzip", strings.HasSuffix(file, ".gz")) {
+		gz = gzip.NewWriter(counter)
+		out = gz
+	}
+
+	d := &dumper{
+		db:        db,
+		driver:    driver,
+		w:         bufio.NewWriter(out),
+		schema:    conf.GetBoolean("schema", true),
+		data:      conf.GetBoolean("data", true),
+		drop:      conf.GetBoolean("drop", false),
+		batchSize: int(conf.GetInt32("batch-size", 500)),
+	}
+
+	if d.batchSize <= 0 {
+		d.batchSize = 500
+	}
+
+	err = d.dump(tables)
+	if err != nil {
+		return
+	}
+
+	if err = d.w.Flush(); err != nil {
+		return
+	}
+
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			return
+		}
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(DumpOutput{
+		File:   file,
+		SHA256: fmt.Sprintf("%0x", hasher.Sum(nil)),
+		Size:   counter.written,
+		Tables: tables,
+	})
+
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+
+	return
+}
+
+func Restore(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	file := conf.GetString("file")
+	if len(file) == 0 {
+		err = fmt.Errorf("config of file could not be empty, e.g.: file = \"/backup/test.sql.gz\"")
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	checksum := fmt.Sprintf("%0x", sha256.Sum256(data))
+
+	if expect := conf.GetString("sha256"); len(expect) > 0 && expect != checksum {
+		err = fmt.Errorf("checksum of %s mismatch, expect: %s, actual: %s", file, expect, checksum)
+		return
+	}
+
+	// gzip magic number
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		data, err = ioutil.ReadAll(gz)
+		gz.Close()
+
+		if err != nil {
+			return
+		}
+	}
+
+	sqls, err := splitSQL(string(data), driver.Dialect)
+	if err != nil {
+		return
+	}
+
+	args := make([][]interface{}, len(sqls))
+
+	txOpts, err := newTxOptions(conf)
+	if err != nil {
+		return
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	c := goctx.Background()
+
+	output, err := execScript(c, db, driver, conf.GetBoolean("tx", true), txOpts, sqls, args, nil)
+	if err != nil {
+		return
+	}
+
+	logrus.WithField("FILE", file).WithField("STATEMENTS", len(sqls)).Infoln("Restore success")
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	outputData, err := json.Marshal(RestoreOutput{
+		File:         file,
+		SHA256:       checksum,
+		Statements:   len(sqls),
+		RowsAffected: output.RowsAffected,
+	})
+
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: outputData, Tags: Tags})
+
+	return
+}
+
+func (p *dumper) dump(tables []DumpTable) (err error) {
+
+	fmt.Fprintf(p.w, "-- toolkit.sql.dump, driver: %s, time: %s\n\n", p.driver.Name, time.Now().Format(time.RFC3339))
+
+	if p.driver.Name == "mysql" {
+		fmt.Fprintln(p.w, "SET FOREIGN_KEY_CHECKS = 0;")
+		fmt.Fprintln(p.w)
+	}
+
+	for i := range tables {
+		if p.schema {
+			if err = p.dumpSchema(tables[i].Name); err != nil {
+				return
+			}
+		}
+
+		if p.data {
+			if tables[i].Rows, err = p.dumpData(tables[i]); err != nil {
+				return
+			}
+
+			if p.driver.Name == "postgres" {
+				if err = p.dumpSequenceValues(tables[i].Name); err != nil {
+					return
+				}
+			}
+		}
+
+		logrus.WithField("TABLE", tables[i].Name).WithField("ROWS", tables[i].Rows).Infoln("Dump table success")
+	}
+
+	if len(p.foreignKeys) > 0 {
+		fmt.Fprintln(p.w, "-- foreign keys")
+		for _, stmt := range p.foreignKeys {
+			fmt.Fprintf(p.w, "%s;\n", stmt)
+		}
+		fmt.Fprintln(p.w)
+	}
+
+	if p.driver.Name == "mysql" {
+		fmt.Fprintln(p.w, "SET FOREIGN_KEY_CHECKS = 1;")
+	}
+
+	return
+}
+
+func (p *dumper) dumpSchema(table string) (err error) {
+
+	ddl, err := p.createTableDDL(table)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(p.w, "-- table: %s\n", table)
+
+	if p.drop {
+		// the foreign keys of the other tables referencing it are added again at the end
+		if p.driver.Name == "postgres" {
+			fmt.Fprintf(p.w, "DROP TABLE IF EXISTS %s CASCADE;\n", p.driver.Dialect.QuoteIdentifier(table))
+		} else {
+			fmt.Fprintf(p.w, "DROP TABLE IF EXISTS %s;\n", p.driver.Dialect.QuoteIdentifier(table))
+		}
+	}
+
+	var sequences []postgresSequence
+
+	// the sequences of serial columns are created before the table, the
+	// sequences of identity columns are created with the table
+	if p.driver.Name == "postgres" {
+		sequences, err = postgresSequences(p.db, p.driver.Dialect, table)
+		if err != nil {
+			return
+		}
+
+		var foreignKeys []string
+		foreignKeys, err = postgresForeignKeys(p.db, p.driver.Dialect, table)
+		if err != nil {
+			return
+		}
+
+		p.foreignKeys = append(p.foreignKeys, foreignKeys...)
+
+		for _, seq := range sequences {
+			if !seq.Identity {
+				fmt.Fprintf(p.w, "CREATE SEQUENCE IF NOT EXISTS %s;\n", seq.Name)
+			}
+		}
+	}
+
+	fmt.Fprintf(p.w, "%s;\n", strings.TrimSuffix(strings.TrimSpace(ddl), ";"))
+
+	for _, seq := range sequences {
+		if !seq.Identity {
+			fmt.Fprintf(p.w, "ALTER SEQUENCE %s OWNED BY %s.%s;\n", seq.Name, p.driver.Dialect.QuoteIdentifier(table), p.driver.Dialect.QuoteIdentifier(seq.Column))
+		}
+	}
+
+	fmt.Fprintln(p.w)
+
+	return
+}
+
+type postgresSequence struct {
+	// quoted name with schema
+	Name     string
+	Column   string
+	Identity bool
+}
+
+// postgresSequences returns the sequences owned by the columns of table,
+// serial columns own the sequences by auto dependency, identity columns by
+// internal dependency
+func postgresSequences(db *sql.DB, dialect sqlDialect, table string) (sequences []postgresSequence, err error) {
+
+	rows, err := db.Query(`SELECT quote_ident(sn.nspname) || '.' || quote_ident(s.relname), a.attname, d.deptype = 'i'
+FROM pg_depend d
+JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+JOIN pg_namespace sn ON sn.oid = s.relnamespace
+JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+AND d.deptype IN ('a', 'i') AND d.refobjid = $1::regclass
+ORDER BY a.attnum`, dialect.QuoteIdentifier(table))
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		seq := postgresSequence{}
+		if err = rows.Scan(&seq.Name, &seq.Column, &seq.Identity); err != nil {
+			return
+		}
+		sequences = append(sequences, seq)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// dumpSequenceValues writes setval of the sequences, so the restored table
+// continues with the next value instead of conflicting with the dumped rows
+func (p *dumper) dumpSequenceValues(table string) (err error) {
+
+	sequences, err := postgresSequences(p.db, p.driver.Dialect, table)
+	if err != nil {
+		return
+	}
+
+	for _, seq := range sequences {
+		var (
+			lastValue int64
+			isCalled  bool
+		)
+
+		if err = p.db.QueryRow("SELECT last_value, is_called FROM "+seq.Name).Scan(&lastValue, &isCalled); err != nil {
+			return
+		}
+
+		// the name of identity sequence is generated on restore, it is resolved by column
+		fmt.Fprintf(p.w, "SELECT setval(pg_get_serial_sequence(%s, %s), %d, %t);\n",
+			p.driver.Dialect.QuoteLiteral(p.driver.Dialect.QuoteIdentifier(table)),
+			p.driver.Dialect.QuoteLiteral(seq.Column),
+			lastValue, isCalled)
+	}
+
+	if len(sequences) > 0 {
+		fmt.Fprintln(p.w)
+	}
+
+	return
+}
+
+func (p *dumper) createTableDDL(table string) (ddl string, err error) {
+
+	switch p.driver.Name {
+	case "mysql":
+		var name string
+		err = p.db.QueryRow("SHOW CREATE TABLE "+p.driver.Dialect.QuoteIdentifier(table)).Scan(&name, &ddl)
+	case "sqlite3":
+		err = p.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&ddl)
+	case "postgres":
+		ddl, err = postgresCreateTableDDL(p.db, p.driver.Dialect, table)
+	default:
+		err = fmt.Errorf("dump schema is not supported by driver %s, set schema = false", p.driver.Name)
+	}
+
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("table %s not found", table)
+	}
+
+	return
+}
+
+// postgresCreateTableDDL builds the DDL with columns and constraints from
+// pg_catalog, the indexes which are not constraints follow the table, the
+// foreign keys are returned by postgresForeignKeys
+func postgresCreateTableDDL(db *sql.DB, dialect sqlDialect, table string) (ddl string, err error) {
+
+	relation := dialect.QuoteIdentifier(table)
+
+	rows, err := db.Query(`SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull, pg_get_expr(d.adbin, d.adrelid), a.attidentity
+FROM pg_attribute a
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`, relation)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	var items []string
+
+	for rows.Next() {
+		var (
+			column, dataType, identity string
+			notNull                    bool
+			defaultValue               sql.NullString
+		)
+
+		if err = rows.Scan(&column, &dataType, &notNull, &defaultValue, &identity); err != nil {
+			return
+		}
+
+		def := dialect.QuoteIdentifier(column) + " " + dataType
+
+		if notNull {
+			def += " NOT NULL"
+		}
+
+		// the sequence of serial default is created by dumpSchema
+		switch identity {
+		case "a":
+			def += " GENERATED ALWAYS AS IDENTITY"
+		case "d":
+			def += " GENERATED BY DEFAULT AS IDENTITY"
+		default:
+			if defaultValue.Valid {
+				def += " DEFAULT " + defaultValue.String
+			}
+		}
+
+		items = append(items, "    "+def)
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(items) == 0 {
+		err = sql.ErrNoRows
+		return
+	}
+
+	// primary key, unique, check and exclusion constraints
+	constraints, err := postgresConstraints(db, relation, "p", "u", "c", "x")
+	if err != nil {
+		return
+	}
+
+	for _, constraint := range constraints {
+		items = append(items, "    "+constraint)
+	}
+
+	statements := []string{fmt.Sprintf("CREATE TABLE %s (\n%s\n)", relation, strings.Join(items, ",\n"))}
+
+	indexRows, err := db.Query(`SELECT pg_get_indexdef(i.indexrelid) FROM pg_index i
+WHERE i.indrelid = $1::regclass
+AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conrelid = i.indrelid AND c.conindid = i.indexrelid)
+ORDER BY i.indexrelid::regclass::text`, relation)
+	if err != nil {
+		return
+	}
+
+	defer indexRows.Close()
+
+	for indexRows.Next() {
+		var index string
+		if err = indexRows.Scan(&index); err != nil {
+			return
+		}
+		statements = append(statements, index)
+	}
+
+	if err = indexRows.Err(); err != nil {
+		return
+	}
+
+	ddl = strings.Join(statements, ";\n")
+
+	return
+}
+
+// postgresForeignKeys returns the statements adding the foreign keys of
+// table, they are written after all tables, so the order of tables is free
+func postgresForeignKeys(db *sql.DB, dialect sqlDialect, table string) (statements []string, err error) {
+
+	relation := dialect.QuoteIdentifier(table)
+
+	constraints, err := postgresConstraints(db, relation, "f")
+	if err != nil {
+		return
+	}
+
+	for _, constraint := range constraints {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD %s", relation, constraint))
+	}
+
+	return
+}
+
+// postgresConstraints returns "CONSTRAINT name definition" of the types
+func postgresConstraints(db *sql.DB, relation string, types ...string) (constraints []string, err error) {
+
+	rows, err := db.Query(`SELECT quote_ident(conname), pg_get_constraintdef(oid) FROM pg_constraint
+WHERE conrelid = $1::regclass AND contype::text = ANY (string_to_array($2, ','))
+ORDER BY contype, conname`, relation, strings.Join(types, ","))
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, def string
+		if err = rows.Scan(&name, &def); err != nil {
+			return
+		}
+		constraints = append(constraints, "CONSTRAINT "+name+" "+def)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (p *dumper) dumpData(table DumpTable) (count int64, err error) {
+
+	query := "SELECT * FROM " + p.driver.Dialect.QuoteIdentifier(table.Name)
+	if len(table.Where) > 0 {
+		query += " WHERE " + table.Where
+	}
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, col := range columns {
+		quotedColumns[i] = p.driver.Dialect.QuoteIdentifier(col)
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s)", p.driver.Dialect.QuoteIdentifier(table.Name), strings.Join(quotedColumns, ", "))
+
+	// the values of GENERATED ALWAYS identity are rejected without overriding
+	if p.driver.Name == "postgres" {
+		var always bool
+		err = p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = $1::regclass AND attidentity = 'a' AND NOT attisdropped)",
+			p.driver.Dialect.QuoteIdentifier(table.Name)).Scan(&always)
+		if err != nil {
+			return
+		}
+
+		if always {
+			insert += " OVERRIDING SYSTEM VALUE"
+		}
+	}
+
+	insert += " VALUES\n"
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	batch := 0
+
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+
+		if batch == 0 {
+			p.w.WriteString(insert)
+		} else {
+			p.w.WriteString(",\n")
+		}
+
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = p.literal(v)
+		}
+
+		p.w.WriteString("(" + strings.Join(literals, ", ") + ")")
+
+		batch++
+		count++
+
+		if batch >= p.batchSize {
+			p.w.WriteString(";\n")
+			batch = 0
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if batch > 0 {
+		p.w.WriteString(";\n")
+	}
+
+	p.w.WriteString("\n")
+
+	return
+}
+
+// literal formats the raw value scanned from driver as sql literal
+func (p *dumper) literal(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if p.driver.Name == "mysql" || p.driver.Name == "sqlite3" {
+			if value {
+				return "1"
+			}
+			return "0"
+		}
+		return strings.ToUpper(strconv.FormatBool(value))
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case time.Time:
+		// the offset keeps timestamptz independent of the TimeZone of restoring
+		// session, it is ignored by timestamp without time zone, the DATETIME of
+		// mysql has no zone
+		if p.driver.Name == "postgres" {
+			return p.driver.Dialect.QuoteLiteral(value.Format("2006-01-02 15:04:05.999999999Z07:00"))
+		}
+		return p.driver.Dialect.QuoteLiteral(value.Format("2006-01-02 15:04:05.999999999"))
+	case []byte:
+		if !utf8.Valid(value) {
+			if p.driver.Name == "postgres" {
+				return `'\x` + hex.EncodeToString(value) + `'`
+			}
+			return "X'" + hex.EncodeToString(value) + "'"
+		}
+		return p.driver.Dialect.QuoteLiteral(string(value))
+	case string:
+		return p.driver.Dialect.QuoteLiteral(value)
+	}
+
+	return p.driver.Dialect.QuoteLiteral(fmt.Sprint(v))
+}
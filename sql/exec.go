@@ -0,0 +1,317 @@
+package pwgen
+
+import (
+	goctx "context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gogap/config"
+	"github.com/sirupsen/logrus"
+)
+
+// sqlExecutor is implemented by *sql.Tx and *sql.Conn
+type sqlExecutor interface {
+	ExecContext(ctx goctx.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx goctx.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// statementError keeps the error of driver, so its code could be read by IsRetryable
+type statementError struct {
+	Index int
+	Err   error
+}
+
+func (p *statementError) Error() string {
+	return fmt.Sprintf("execute statement %d failure: %s", p.Index, p.Err)
+}
+
+type StatementResult struct {
+	Source       string   `json:"source,omitempty"`
+	Index        int      `json:"index"`
+	SQL          string   `json:"sql"`
+	RowsAffected int64    `json:"rows_affected"`
+	LastInsertID *int64   `json:"last_insert_id,omitempty"`
+	Duration     string   `json:"duration"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+type SourceResult struct {
+	Name         string `json:"name"`
+	Statements   int    `json:"statements"`
+	RowsAffected int64  `json:"rows_affected"`
+	Error        string `json:"error,omitempty"`
+}
+
+type ExecOutput struct {
+	Statements   []StatementResult `json:"statements"`
+	RowsAffected int64             `json:"rows_affected"`
+	Sources      []SourceResult    `json:"sources,omitempty"`
+}
+
+// rowsAffectedExpect is the assertion of rows affected, -1 means unset
+type rowsAffectedExpect struct {
+	Exact int64
+	Min   int64
+	Max   int64
+}
+
+func (p rowsAffectedExpect) Check(n int64) error {
+	if p.Exact >= 0 && n != p.Exact {
+		return fmt.Errorf("expect %d rows affected, but got %d", p.Exact, n)
+	}
+
+	if p.Min >= 0 && n < p.Min {
+		return fmt.Errorf("expect at least %d rows affected, but got %d", p.Min, n)
+	}
+
+	if p.Max >= 0 && n > p.Max {
+		return fmt.Errorf("expect at most %d rows affected, but got %d", p.Max, n)
+	}
+
+	return nil
+}
+
+// newRowsAffectedExpects reads the assertions keyed by 'total' or the index of statement (start from 1)
+func newRowsAffectedExpects(conf config.Configuration) map[string]rowsAffectedExpect {
+
+	if conf.IsEmpty() {
+		return nil
+	}
+
+	expects := map[string]rowsAffectedExpect{}
+
+	for _, key := range conf.Keys() {
+		expectConf := conf.GetConfig(key)
+		if expectConf.IsEmpty() {
+			continue
+		}
+
+		expects[key] = rowsAffectedExpect{
+			Exact: expectConf.GetInt64("exact", -1),
+			Min:   expectConf.GetInt64("min", -1),
+			Max:   expectConf.GetInt64("max", -1),
+		}
+	}
+
+	return expects
+}
+
+type txOptions struct {
+	sql.TxOptions
+
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+	Retries          int
+	RetryInterval    time.Duration
+}
+
+var isolationLevels = map[string]sql.IsolationLevel{
+	"":                 sql.LevelDefault,
+	"read-uncommitted": sql.LevelReadUncommitted,
+	"read-committed":   sql.LevelReadCommitted,
+	"repeatable-read":  sql.LevelRepeatableRead,
+	"snapshot":         sql.LevelSnapshot,
+	"serializable":     sql.LevelSerializable,
+}
+
+func newTxOptions(conf config.Configuration) (opts txOptions, err error) {
+
+	isolation := conf.GetString("isolation")
+
+	level, exist := isolationLevels[isolation]
+	if !exist {
+		err = fmt.Errorf("unknown isolation: %s, should be one of read-uncommitted, read-committed, repeatable-read, snapshot, serializable", isolation)
+		return
+	}
+
+	opts = txOptions{
+		TxOptions: sql.TxOptions{
+			Isolation: level,
+			ReadOnly:  conf.GetBoolean("read-only", false),
+		},
+		StatementTimeout: conf.GetTimeDuration("statement-timeout", 0),
+		LockTimeout:      conf.GetTimeDuration("lock-timeout", 0),
+		Retries:          int(conf.GetInt32("retries", 0)),
+		RetryInterval:    conf.GetTimeDuration("retry-interval", time.Millisecond*100),
+	}
+
+	return
+}
+
+// execScript executes the statements in a transaction if tx is true,
+// otherwise one by one on a single connection
+func execScript(c goctx.Context, db *sql.DB, driver sqlDriver, tx bool, opts txOptions, sqls []string, args [][]interface{}, expects map[string]rowsAffectedExpect) (output *ExecOutput, err error) {
+
+	if tx {
+		return execTx(c, db, driver, opts, sqls, args, expects)
+	}
+
+	conn, err := db.Conn(c)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	settings := driver.SessionSettings(opts.StatementTimeout, opts.LockTimeout, false)
+
+	if len(settings) > 0 {
+		defer resetSession(c, conn, driver)
+	}
+
+	for _, setting := range settings {
+		if _, err = conn.ExecContext(c, setting); err != nil {
+			return
+		}
+	}
+
+	return execStatements(c, conn, driver, opts.StatementTimeout, sqls, args, expects)
+}
+
+// execTx executes the statements in a transaction, the whole transaction is
+// retried on serialization failure or deadlock
+func execTx(c goctx.Context, db *sql.DB, driver sqlDriver, opts txOptions, sqls []string, args [][]interface{}, expects map[string]rowsAffectedExpect) (output *ExecOutput, err error) {
+
+	for attempt := 0; ; attempt++ {
+
+		output, err = execTxOnce(c, db, driver, opts, sqls, args, expects)
+
+		if err == nil || attempt >= opts.Retries || !driver.IsRetryable(err) {
+			return
+		}
+
+		logrus.WithField("ATTEMPT", attempt+1).WithField("ERROR", err.Error()).Warnln("Retrying transaction")
+
+		time.Sleep(opts.RetryInterval * time.Duration(attempt+1))
+	}
+}
+
+func execTxOnce(c goctx.Context, db *sql.DB, driver sqlDriver, opts txOptions, sqls []string, args [][]interface{}, expects map[string]rowsAffectedExpect) (output *ExecOutput, err error) {
+
+	conn, err := db.Conn(c)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(c, &opts.TxOptions)
+	if err != nil {
+		return
+	}
+
+	settings := driver.SessionSettings(opts.StatementTimeout, opts.LockTimeout, true)
+
+	// mysql and mssql have no transaction scoped settings
+	if len(settings) > 0 {
+		defer resetSession(c, conn, driver)
+	}
+
+	for _, setting := range settings {
+		if _, err = tx.ExecContext(c, setting); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	output, err = execStatements(c, tx, driver, opts.StatementTimeout, sqls, args, expects)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+
+	return
+}
+
+func execStatements(c goctx.Context, executor sqlExecutor, driver sqlDriver, timeout time.Duration, sqls []string, args [][]interface{}, expects map[string]rowsAffectedExpect) (output *ExecOutput, err error) {
+
+	output = &ExecOutput{}
+
+	for i := 0; i < len(sqls); i++ {
+
+		start := time.Now()
+
+		stmtCtx := c
+		cancel := goctx.CancelFunc(func() {})
+
+		if timeout > 0 {
+			stmtCtx, cancel = goctx.WithTimeout(c, timeout)
+		}
+
+		var result sql.Result
+		result, err = executor.ExecContext(stmtCtx, sqls[i], args[i]...)
+		cancel()
+
+		if err != nil {
+			err = &statementError{Index: i + 1, Err: err}
+			return
+		}
+
+		stmtResult := StatementResult{
+			Index:    i + 1,
+			SQL:      sqls[i],
+			Duration: time.Since(start).String(),
+		}
+
+		// not all drivers support them
+		if n, e := result.RowsAffected(); e == nil {
+			stmtResult.RowsAffected = n
+		}
+
+		if id, e := result.LastInsertId(); e == nil && id > 0 {
+			stmtResult.LastInsertID = &id
+		}
+
+		if driver.Name == "mysql" {
+			stmtResult.Warnings, err = mysqlWarnings(c, executor)
+			if err != nil {
+				return
+			}
+		}
+
+		output.Statements = append(output.Statements, stmtResult)
+		output.RowsAffected += stmtResult.RowsAffected
+
+		if expect, exist := expects[strconv.Itoa(i+1)]; exist {
+			if err = expect.Check(stmtResult.RowsAffected); err != nil {
+				err = fmt.Errorf("statement %d: %s", i+1, err)
+				return
+			}
+		}
+	}
+
+	if expect, exist := expects["total"]; exist {
+		if err = expect.Check(output.RowsAffected); err != nil {
+			err = fmt.Errorf("total: %s", err)
+			return
+		}
+	}
+
+	return
+}
+
+func mysqlWarnings(c goctx.Context, executor sqlExecutor) (warnings []string, err error) {
+	rows, err := executor.QueryContext(c, "SHOW WARNINGS")
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var level, message string
+		var code int
+		if err = rows.Scan(&level, &code, &message); err != nil {
+			return
+		}
+		warnings = append(warnings, fmt.Sprintf("%s %d: %s", level, code, message))
+	}
+
+	err = rows.Err()
+
+	return
+}
@@ -0,0 +1,399 @@
+package pwgen
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+type exportOptions struct {
+	File       string
+	Format     string
+	Gzip       bool
+	FetchSize  int
+	FlushRows  int
+	ColumnCase string
+}
+
+type ExportOutput struct {
+	File    string         `json:"file"`
+	Format  string         `json:"format"`
+	Gzip    bool           `json:"gzip"`
+	Rows    int64          `json:"rows"`
+	SHA256  string         `json:"sha256"`
+	Columns []ColumnSchema `json:"columns"`
+}
+
+type rowWriter interface {
+	WriteRow(values []interface{}) error
+	Flush() error
+	Close() error
+}
+
+func newExportOptions(conf config.Configuration) exportOptions {
+	return exportOptions{
+		File:       conf.GetString("export.file"),
+		Format:     conf.GetString("export.format", "ndjson"),
+		Gzip:       conf.GetBoolean("export.gzip", false),
+		FetchSize:  int(conf.GetInt32("export.fetch-size", 0)),
+		FlushRows:  int(conf.GetInt32("export.flush-rows", 10000)),
+		ColumnCase: conf.GetString("column-case", "lower"),
+	}
+}
+
+// exportQuery streams the rows of query to file, only the metadata are kept in memory
+func exportQuery(db *sql.DB, driver sqlDriver, opts exportOptions, query string, args ...interface{}) (output *ExportOutput, err error) {
+
+	switch opts.Format {
+	case "ndjson", "csv", "tsv", "parquet":
+	default:
+		err = fmt.Errorf("unsupported export format: %s, should be one of ndjson, csv, tsv, parquet", opts.Format)
+		return
+	}
+
+	f, err := os.Create(opts.File)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	hasher := sha256.New()
+
+	exporter := &exporter{
+		opts: opts,
+		out:  io.MultiWriter(f, hasher),
+	}
+
+	if opts.FetchSize > 0 && driver.Name == "postgres" {
+		err = exporter.exportByCursor(db, query, args...)
+	} else {
+		err = exporter.export(db, query, args...)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	output = &ExportOutput{
+		File:    opts.File,
+		Format:  opts.Format,
+		Gzip:    opts.Gzip && opts.Format != "parquet",
+		Rows:    exporter.rows,
+		SHA256:  fmt.Sprintf("%0x", hasher.Sum(nil)),
+		Columns: exporter.schema,
+	}
+
+	return
+}
+
+type exporter struct {
+	opts   exportOptions
+	out    io.Writer
+	writer rowWriter
+	schema []ColumnSchema
+	rows   int64
+}
+
+func (p *exporter) export(db *sql.DB, query string, args ...interface{}) (err error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	if _, err = p.writeRows(rows); err != nil {
+		return
+	}
+
+	return p.close()
+}
+
+// exportByCursor fetches rows from a postgres cursor by fetch-size
+func (p *exporter) exportByCursor(db *sql.DB, query string, args ...interface{}) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DECLARE toolkit_export NO SCROLL CURSOR FOR "+query, args...)
+	if err != nil {
+		return
+	}
+
+	for {
+		var rows *sql.Rows
+		rows, err = tx.Query(fmt.Sprintf("FETCH %d FROM toolkit_export", p.opts.FetchSize))
+		if err != nil {
+			return
+		}
+
+		var n int64
+		n, err = p.writeRows(rows)
+		rows.Close()
+
+		if err != nil {
+			return
+		}
+
+		if n < int64(p.opts.FetchSize) {
+			break
+		}
+	}
+
+	return p.close()
+}
+
+func (p *exporter) writeRows(rows *sql.Rows) (n int64, err error) {
+	scanner, err := newRowScanner(rows, p.opts.ColumnCase)
+	if err != nil {
+		return
+	}
+
+	if p.writer == nil {
+		p.schema = scanner.Schema
+		p.writer, err = newRowWriter(p.out, p.opts, scanner)
+		if err != nil {
+			return
+		}
+	}
+
+	for rows.Next() {
+		var values []interface{}
+		values, err = scanner.Scan(rows)
+		if err != nil {
+			return
+		}
+
+		if err = p.writer.WriteRow(values); err != nil {
+			return
+		}
+
+		n++
+		p.rows++
+
+		if p.opts.FlushRows > 0 && p.rows%int64(p.opts.FlushRows) == 0 {
+			if err = p.writer.Flush(); err != nil {
+				return
+			}
+			logrus.WithField("FILE", p.opts.File).WithField("ROWS", p.rows).Debugln("Exporting rows")
+		}
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (p *exporter) close() error {
+	if p.writer == nil {
+		return nil
+	}
+	return p.writer.Close()
+}
+
+func newRowWriter(out io.Writer, opts exportOptions, scanner *rowScanner) (rowWriter, error) {
+
+	if opts.Format == "parquet" {
+		return newParquetRowWriter(out, opts, scanner)
+	}
+
+	stream := &textStream{}
+
+	if opts.Gzip {
+		stream.gzip = gzip.NewWriter(out)
+		stream.buf = bufio.NewWriter(stream.gzip)
+	} else {
+		stream.buf = bufio.NewWriter(out)
+	}
+
+	switch opts.Format {
+	case "csv", "tsv":
+		w := csv.NewWriter(stream.buf)
+		if opts.Format == "tsv" {
+			w.Comma = '\t'
+		}
+
+		if err := w.Write(scanner.Columns); err != nil {
+			return nil, err
+		}
+
+		return &csvRowWriter{textStream: stream, csv: w}, nil
+	}
+
+	return &ndjsonRowWriter{textStream: stream, columns: scanner.Columns}, nil
+}
+
+// textStream is the buffered and optional gzip compressed output of text formats
+type textStream struct {
+	buf  *bufio.Writer
+	gzip *gzip.Writer
+}
+
+func (p *textStream) Flush() error {
+	if err := p.buf.Flush(); err != nil {
+		return err
+	}
+
+	if p.gzip != nil {
+		return p.gzip.Flush()
+	}
+
+	return nil
+}
+
+func (p *textStream) Close() error {
+	if err := p.buf.Flush(); err != nil {
+		return err
+	}
+
+	if p.gzip != nil {
+		return p.gzip.Close()
+	}
+
+	return nil
+}
+
+type ndjsonRowWriter struct {
+	*textStream
+	columns []string
+}
+
+func (p *ndjsonRowWriter) WriteRow(values []interface{}) error {
+	line, err := json.Marshal(resultRow{columns: p.columns, values: values})
+	if err != nil {
+		return err
+	}
+
+	if _, err = p.buf.Write(line); err != nil {
+		return err
+	}
+
+	return p.buf.WriteByte('\n')
+}
+
+type csvRowWriter struct {
+	*textStream
+	csv *csv.Writer
+}
+
+func (p *csvRowWriter) WriteRow(values []interface{}) error {
+	return p.csv.Write(formatTextRow(values))
+}
+
+func (p *csvRowWriter) Flush() error {
+	p.csv.Flush()
+	if err := p.csv.Error(); err != nil {
+		return err
+	}
+	return p.textStream.Flush()
+}
+
+func (p *csvRowWriter) Close() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	return p.textStream.Close()
+}
+
+type parquetRowWriter struct {
+	writer  *writer.JSONWriter
+	columns []string
+	types   []string
+}
+
+func newParquetRowWriter(out io.Writer, opts exportOptions, scanner *rowScanner) (rowWriter, error) {
+
+	fields := make([]string, len(scanner.Columns))
+	types := make([]string, len(scanner.Columns))
+
+	for i, col := range scanner.Columns {
+		types[i] = parquetType(scanner.types[i])
+
+		fieldType := "type=" + types[i]
+		if types[i] == "BYTE_ARRAY" {
+			fieldType += ", convertedtype=UTF8"
+		}
+
+		tag, err := json.Marshal(fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", col, fieldType))
+		if err != nil {
+			return nil, err
+		}
+
+		fields[i] = fmt.Sprintf(`{"Tag":%s}`, tag)
+	}
+
+	schema := fmt.Sprintf(`{"Tag":"name=parquet_go_root, repetitiontype=REQUIRED","Fields":[%s]}`, strings.Join(fields, ","))
+
+	w, err := writer.NewJSONWriter(schema, writerfile.NewWriterFile(out), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Gzip {
+		w.CompressionType = parquet.CompressionCodec_GZIP
+	} else {
+		w.CompressionType = parquet.CompressionCodec_SNAPPY
+	}
+
+	return &parquetRowWriter{writer: w, columns: scanner.Columns, types: types}, nil
+}
+
+func parquetType(dbType string) string {
+	switch convertText("0", dbType).(type) {
+	case int64, uint64:
+		return "INT64"
+	case float64, json.Number:
+		return "DOUBLE"
+	case bool:
+		return "BOOLEAN"
+	}
+
+	return "BYTE_ARRAY"
+}
+
+func (p *parquetRowWriter) WriteRow(values []interface{}) error {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		if v == nil || p.types[i] != "BYTE_ARRAY" {
+			row[i] = v
+			continue
+		}
+		row[i] = formatTextValue(v)
+	}
+
+	line, err := json.Marshal(resultRow{columns: p.columns, values: row})
+	if err != nil {
+		return err
+	}
+
+	return p.writer.Write(string(line))
+}
+
+func (p *parquetRowWriter) Flush() error {
+	return p.writer.Flush(true)
+}
+
+func (p *parquetRowWriter) Close() error {
+	return p.writer.WriteStop()
+}
@@ -0,0 +1,742 @@
+package pwgen
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	goctx "context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+// the max count of bind params in one statement
+var maxBindParams = map[string]int{
+	"mysql":     65535,
+	"postgres":  65535,
+	"sqlserver": 2100,
+	"sqlite3":   999,
+}
+
+type ImportOutput struct {
+	Table        string `json:"table"`
+	Rows         int64  `json:"rows"`
+	RowsAffected int64  `json:"rows_affected"`
+	Batches      int    `json:"batches"`
+}
+
+// recordReader reads the records one by one, io.EOF is returned at the end
+type recordReader interface {
+	Fields() []string
+	Read() (map[string]interface{}, error)
+}
+
+type importOptions struct {
+	Table           string
+	Method          string
+	BatchSize       int
+	OnConflict      string
+	ConflictColumns []string
+	Columns         []string
+	Sources         []string
+	Types           map[string]string
+	EmptyAsNull     bool
+	Tx              bool
+	Truncate        bool
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.import", Import)
+}
+
+func Import(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	opts, err := newImportOptions(conf, driver)
+	if err != nil {
+		return
+	}
+
+	if len(opts.Table) == 0 {
+		err = fmt.Errorf("config of table could not be empty")
+		return
+	}
+
+	reader, closer, err := openRecordReader(ctx, conf)
+	if err != nil {
+		return
+	}
+
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	// all fields of source are imported if columns is not configured
+	if len(opts.Columns) == 0 {
+		opts.Columns = reader.Fields()
+		opts.Sources = opts.Columns
+	}
+
+	if len(opts.Columns) == 0 {
+		err = fmt.Errorf("no columns to import into %s", opts.Table)
+		return
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	imp := &importer{
+		driver: driver,
+		opts:   opts,
+		reader: reader,
+		output: &ImportOutput{Table: opts.Table},
+	}
+
+	err = imp.run(db)
+	if err != nil {
+		return
+	}
+
+	logrus.WithField("TABLE", opts.Table).WithField("ROWS", imp.output.Rows).Infoln("Import success")
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(imp.output)
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+
+	return
+}
+
+func newImportOptions(conf config.Configuration, driver sqlDriver) (opts importOptions, err error) {
+
+	opts = importOptions{
+		Table:           conf.GetString("table"),
+		Method:          conf.GetString("method", "insert"),
+		BatchSize:       int(conf.GetInt32("batch-size", 500)),
+		OnConflict:      conf.GetString("on-conflict", "error"),
+		ConflictColumns: conf.GetStringList("conflict-columns"),
+		Types:           map[string]string{},
+		EmptyAsNull:     conf.GetBoolean("empty-as-null", false),
+		Tx:              conf.GetBoolean("tx", true),
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+
+	switch opts.Method {
+	case "insert":
+	case "copy":
+		if driver.Name != "postgres" {
+			err = fmt.Errorf("method copy is only supported by postgres")
+			return
+		}
+
+		if opts.OnConflict != "error" {
+			err = fmt.Errorf("method copy does not support on-conflict = %s", opts.OnConflict)
+			return
+		}
+
+		if !opts.Tx {
+			err = fmt.Errorf("method copy requires tx = true")
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown method: %s, should be one of insert, copy", opts.Method)
+		return
+	}
+
+	switch opts.OnConflict {
+	case "error", "ignore":
+	case "update":
+		if len(opts.ConflictColumns) == 0 && driver.Name != "mysql" {
+			err = fmt.Errorf("on-conflict = update requires conflict-columns")
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown on-conflict: %s, should be one of error, ignore, update", opts.OnConflict)
+		return
+	}
+
+	if opts.OnConflict != "error" {
+		switch driver.Name {
+		case "mysql", "postgres", "sqlite3":
+		default:
+			err = fmt.Errorf("on-conflict = %s is not supported by driver %s", opts.OnConflict, driver.Name)
+			return
+		}
+	}
+
+	// columns { target = "source field" }
+	columnsConf := conf.GetConfig("columns")
+	if !columnsConf.IsEmpty() {
+		opts.Columns = columnsConf.Keys()
+		sort.Strings(opts.Columns)
+
+		for _, column := range opts.Columns {
+			opts.Sources = append(opts.Sources, columnsConf.GetString(column, column))
+		}
+	}
+
+	typesConf := conf.GetConfig("types")
+	if !typesConf.IsEmpty() {
+		for _, column := range typesConf.Keys() {
+			typ := typesConf.GetString(column)
+
+			switch typ {
+			case "string", "int", "float", "bool", "json", "time":
+			default:
+				err = fmt.Errorf("unknown type of column %s: %s, should be one of string, int, float, bool, json, time", column, typ)
+				return
+			}
+
+			opts.Types[column] = typ
+		}
+	}
+
+	return
+}
+
+// openRecordReader reads records from file, or the output of previous step
+func openRecordReader(ctx context.Context, conf config.Configuration) (reader recordReader, closer io.Closer, err error) {
+
+	format := conf.GetString("format")
+
+	var in io.Reader
+
+	if outputName := conf.GetString("from-output"); len(outputName) > 0 {
+		outputs := flow.FindOutput(ctx, outputName, conf.GetStringList("from-output-tags")...)
+
+		if len(outputs) == 0 {
+			err = fmt.Errorf("output of %s not found", outputName)
+			return
+		} else if len(outputs) > 1 {
+			err = fmt.Errorf("conflict of output name: %s, set from-output-tags to filter", outputName)
+			return
+		}
+
+		in = bytes.NewReader(outputs[0].Value)
+
+		if len(format) == 0 {
+			format = "json"
+		}
+	} else {
+		file := conf.GetString("file")
+		if len(file) == 0 {
+			err = fmt.Errorf("config of file or from-output could not be empty")
+			return
+		}
+
+		var f *os.File
+		f, err = os.Open(file)
+		if err != nil {
+			return
+		}
+
+		closer = f
+
+		buf := bufio.NewReader(f)
+
+		// gzip magic number
+		if magic, _ := buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			var gz *gzip.Reader
+			gz, err = gzip.NewReader(buf)
+			if err != nil {
+				f.Close()
+				return
+			}
+			in = gz
+		} else {
+			in = buf
+		}
+
+		if len(format) == 0 {
+			format = formatOfFile(file)
+		}
+	}
+
+	switch format {
+	case "csv", "tsv":
+		r := csv.NewReader(in)
+		if format == "tsv" {
+			r.Comma = '\t'
+		}
+		r.ReuseRecord = true
+
+		var header []string
+		header, err = r.Read()
+		if err != nil {
+			err = fmt.Errorf("read header of csv failure: %s", err)
+			break
+		}
+
+		reader = &csvRecordReader{reader: r, fields: append([]string(nil), header...)}
+	case "ndjson":
+		reader, err = newJSONRecordReader(in, false)
+	case "json":
+		reader, err = newJSONRecordReader(in, true)
+	default:
+		err = fmt.Errorf("unknown format: %s, should be one of csv, tsv, ndjson, json", format)
+	}
+
+	if err != nil && closer != nil {
+		closer.Close()
+		closer = nil
+	}
+
+	return
+}
+
+func formatOfFile(file string) string {
+	name := strings.TrimSuffix(file, ".gz")
+
+	for _, format := range []string{"csv", "tsv", "ndjson", "json"} {
+		if strings.HasSuffix(name, "."+format) {
+			return format
+		}
+	}
+
+	return "csv"
+}
+
+type csvRecordReader struct {
+	reader *csv.Reader
+	fields []string
+	line   int
+}
+
+func (p *csvRecordReader) Fields() []string {
+	return p.fields
+}
+
+func (p *csvRecordReader) Read() (map[string]interface{}, error) {
+	values, err := p.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	p.line++
+
+	if len(values) != len(p.fields) {
+		return nil, fmt.Errorf("record %d has %d fields, but header has %d", p.line, len(values), len(p.fields))
+	}
+
+	record := make(map[string]interface{}, len(values))
+	for i, field := range p.fields {
+		record[field] = values[i]
+	}
+
+	return record, nil
+}
+
+// jsonRecordReader reads a json array or json values separated by newline
+type jsonRecordReader struct {
+	decoder *json.Decoder
+	array   bool
+	first   map[string]interface{}
+	fields  []string
+}
+
+func newJSONRecordReader(in io.Reader, array bool) (*jsonRecordReader, error) {
+	decoder := json.NewDecoder(in)
+	decoder.UseNumber()
+
+	reader := &jsonRecordReader{decoder: decoder, array: array}
+
+	if array {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("read json array failure: %s", err)
+		}
+
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("read json array failure: the input is not an array")
+		}
+	}
+
+	// the fields are the keys of first record
+	first, err := reader.next()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	reader.first = first
+
+	for field := range first {
+		reader.fields = append(reader.fields, field)
+	}
+
+	sort.Strings(reader.fields)
+
+	return reader, nil
+}
+
+func (p *jsonRecordReader) Fields() []string {
+	return p.fields
+}
+
+func (p *jsonRecordReader) Read() (map[string]interface{}, error) {
+	if p.first != nil {
+		record := p.first
+		p.first = nil
+		return record, nil
+	}
+
+	return p.next()
+}
+
+func (p *jsonRecordReader) next() (map[string]interface{}, error) {
+	if !p.decoder.More() {
+		return nil, io.EOF
+	}
+
+	record := map[string]interface{}{}
+	if err := p.decoder.Decode(&record); err != nil {
+		return nil, fmt.Errorf("read json record failure: %s", err)
+	}
+
+	return record, nil
+}
+
+type importer struct {
+	driver sqlDriver
+	opts   importOptions
+	reader recordReader
+	output *ImportOutput
+}
+
+func (p *importer) run(db *sql.DB) (err error) {
+
+	c := goctx.Background()
+
+	var executor interface {
+		sqlExecutor
+		PrepareContext(goctx.Context, string) (*sql.Stmt, error)
+	}
+
+	var tx *sql.Tx
+
+	if p.opts.Tx {
+		tx, err = db.BeginTx(c, nil)
+		if err != nil {
+			return
+		}
+
+		executor = tx
+	} else {
+		executor = db
+	}
+
+	if p.opts.Truncate {
+		err = p.truncate(c, executor)
+	}
+
+	if err == nil {
+		if p.opts.Method == "copy" {
+			err = p.copy(c, executor)
+		} else {
+			err = p.insert(c, executor)
+		}
+	}
+
+	if tx == nil {
+		return
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	return tx.Commit()
+}
+
+// truncate empties the table in the transaction of import, TRUNCATE of mysql
+// commits implicitly and could not be rolled back, so DELETE is used
+func (p *importer) truncate(c goctx.Context, executor sqlExecutor) (err error) {
+
+	stmt := "TRUNCATE TABLE "
+	if p.driver.Name == "mysql" || p.driver.Name == "sqlite3" {
+		stmt = "DELETE FROM "
+	}
+
+	_, err = executor.ExecContext(c, stmt+p.driver.Dialect.QuoteIdentifier(p.opts.Table))
+
+	return
+}
+
+// next reads the record and maps it to the values of columns
+func (p *importer) next() (values []interface{}, err error) {
+	record, err := p.reader.Read()
+	if err != nil {
+		return
+	}
+
+	p.output.Rows++
+
+	values = make([]interface{}, len(p.opts.Columns))
+
+	for i, column := range p.opts.Columns {
+		values[i], err = p.coerce(record[p.opts.Sources[i]], p.opts.Types[column])
+		if err != nil {
+			err = fmt.Errorf("record %d, column %s: %s", p.output.Rows, column, err)
+			return
+		}
+	}
+
+	return
+}
+
+func (p *importer) coerce(v interface{}, typ string) (interface{}, error) {
+
+	if s, ok := v.(string); ok && len(s) == 0 && p.opts.EmptyAsNull {
+		return nil, nil
+	}
+
+	if v == nil {
+		return nil, nil
+	}
+
+	switch typ {
+	case "string":
+		return formatTextValue(v), nil
+	case "int":
+		return strconv.ParseInt(formatTextValue(v), 10, 64)
+	case "float":
+		return strconv.ParseFloat(formatTextValue(v), 64)
+	case "bool":
+		return strconv.ParseBool(formatTextValue(v))
+	case "time":
+		return time.Parse(time.RFC3339Nano, formatTextValue(v))
+	case "json":
+		if s, ok := v.(string); ok {
+			if !json.Valid([]byte(s)) {
+				return nil, fmt.Errorf("invalid json: %s", s)
+			}
+			return s, nil
+		}
+	}
+
+	switch value := v.(type) {
+	case json.Number:
+		return value.String(), nil
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+
+	return v, nil
+}
+
+func (p *importer) insert(c goctx.Context, executor sqlExecutor) (err error) {
+
+	batchSize := p.opts.BatchSize
+
+	if limit, exist := maxBindParams[p.driver.Name]; exist && batchSize*len(p.opts.Columns) > limit {
+		batchSize = limit / len(p.opts.Columns)
+	}
+
+	var args []interface{}
+	rows := 0
+
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+
+		result, err := executor.ExecContext(c, p.insertSQL(rows), args...)
+		if err != nil {
+			return fmt.Errorf("insert batch %d failure: %s", p.output.Batches+1, err)
+		}
+
+		if n, e := result.RowsAffected(); e == nil {
+			p.output.RowsAffected += n
+		}
+
+		p.output.Batches++
+
+		args = args[:0]
+		rows = 0
+
+		return nil
+	}
+
+	for {
+		var values []interface{}
+		values, err = p.next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return
+		}
+
+		args = append(args, values...)
+		rows++
+
+		if rows >= batchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	return flush()
+}
+
+func (p *importer) insertSQL(rows int) string {
+
+	dialect := p.driver.Dialect
+
+	var buf strings.Builder
+
+	switch {
+	case p.opts.OnConflict == "ignore" && p.driver.Name == "mysql":
+		buf.WriteString("INSERT IGNORE INTO ")
+	case p.opts.OnConflict == "ignore" && p.driver.Name == "sqlite3":
+		buf.WriteString("INSERT OR IGNORE INTO ")
+	default:
+		buf.WriteString("INSERT INTO ")
+	}
+
+	buf.WriteString(dialect.QuoteIdentifier(p.opts.Table))
+	buf.WriteString(" (" + quoteIdentifiers(dialect, p.opts.Columns) + ") VALUES ")
+
+	n := 0
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+
+		buf.WriteByte('(')
+		for j := range p.opts.Columns {
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			n++
+			buf.WriteString(p.driver.Placeholder(n))
+		}
+		buf.WriteByte(')')
+	}
+
+	keys := map[string]bool{}
+	for _, column := range p.opts.ConflictColumns {
+		keys[column] = true
+	}
+
+	var updates []string
+
+	for _, column := range p.opts.Columns {
+		if keys[column] {
+			continue
+		}
+
+		quoted := dialect.QuoteIdentifier(column)
+
+		if p.driver.Name == "mysql" {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quoted, quoted))
+		} else {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", quoted, quoted))
+		}
+	}
+
+	target := ""
+	if len(p.opts.ConflictColumns) > 0 {
+		target = " (" + quoteIdentifiers(dialect, p.opts.ConflictColumns) + ")"
+	}
+
+	switch {
+	case p.opts.OnConflict == "ignore" && p.driver.Name == "postgres":
+		buf.WriteString(" ON CONFLICT" + target + " DO NOTHING")
+	case p.opts.OnConflict == "update" && p.driver.Name == "mysql":
+		buf.WriteString(" ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", "))
+	case p.opts.OnConflict == "update" && len(updates) == 0:
+		buf.WriteString(" ON CONFLICT" + target + " DO NOTHING")
+	case p.opts.OnConflict == "update":
+		buf.WriteString(" ON CONFLICT" + target + " DO UPDATE SET " + strings.Join(updates, ", "))
+	}
+
+	return buf.String()
+}
+
+// copy uses the COPY protocol of postgres, lib/pq handles the statement
+// of 'COPY ... FROM STDIN' as a copy-in
+func (p *importer) copy(c goctx.Context, executor interface {
+	PrepareContext(goctx.Context, string) (*sql.Stmt, error)
+}) (err error) {
+
+	dialect := p.driver.Dialect
+
+	stmt, err := executor.PrepareContext(c, fmt.Sprintf("COPY %s (%s) FROM STDIN", dialect.QuoteIdentifier(p.opts.Table), quoteIdentifiers(dialect, p.opts.Columns)))
+	if err != nil {
+		return
+	}
+
+	defer stmt.Close()
+
+	for {
+		var values []interface{}
+		values, err = p.next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return
+		}
+
+		if _, err = stmt.ExecContext(c, values...); err != nil {
+			return
+		}
+
+		if p.output.Rows%int64(p.opts.BatchSize) == 0 {
+			logrus.WithField("TABLE", p.opts.Table).WithField("ROWS", p.output.Rows).Debugln("Copying rows")
+		}
+	}
+
+	// flush the buffered rows
+	if _, err = stmt.ExecContext(c); err != nil {
+		return
+	}
+
+	p.output.RowsAffected = p.output.Rows
+	p.output.Batches = 1
+
+	return
+}
@@ -0,0 +1,502 @@
+package pwgen
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+	identifierRegexp    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+)
+
+type migration struct {
+	Version  int64
+	Name     string
+	UpFile   string
+	DownFile string
+	Checksum string
+}
+
+type MigrationStatus struct {
+	Version   int64  `json:"version"`
+	Name      string `json:"name"`
+	Checksum  string `json:"checksum"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"applied_at,omitempty"`
+	Missing   bool   `json:"missing,omitempty"`
+}
+
+type MigrateOutput struct {
+	Action   string            `json:"action"`
+	Version  int64             `json:"version"`
+	Migrated []int64           `json:"migrated"`
+	Status   []MigrationStatus `json:"status"`
+}
+
+type migrator struct {
+	db         *sql.DB
+	driver     sqlDriver
+	table      string
+	migrations []*migration
+	applied    map[int64]MigrationStatus
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.migrate", Migrate)
+}
+
+func Migrate(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	dir := conf.GetString("dir")
+	if len(dir) == 0 {
+		err = fmt.Errorf("config of dir could not be empty, e.g.: dir = \"migrations\"")
+		return
+	}
+
+	table := conf.GetString("table", "schema_migrations")
+	if !identifierRegexp.MatchString(table) {
+		err = fmt.Errorf("bad migration table name: %s", table)
+		return
+	}
+
+	action := conf.GetString("action", "up")
+	steps := int(conf.GetInt32("steps", 0))
+	target := conf.GetInt64("version", 0)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	m := &migrator{
+		db:         db,
+		driver:     driver,
+		table:      table,
+		migrations: migrations,
+	}
+
+	err = m.prepare()
+	if err != nil {
+		return
+	}
+
+	var migrated []int64
+
+	switch action {
+	case "up":
+		migrated, err = m.up(0, steps)
+	case "down":
+		if steps <= 0 {
+			steps = 1
+		}
+		migrated, err = m.down(-1, steps)
+	case "to":
+		// a missing version must not be read as 0, which reverts all migrations
+		if len(conf.GetString("version")) == 0 {
+			err = fmt.Errorf("config of version could not be empty for action to, use version = 0 to revert all migrations")
+			break
+		}
+
+		if target > 0 && target >= m.current() {
+			migrated, err = m.up(target, 0)
+		} else {
+			migrated, err = m.down(target, 0)
+		}
+	case "baseline":
+		migrated, err = m.baseline(target)
+	case "status":
+		for _, s := range m.status() {
+			logrus.WithField("VERSION", s.Version).WithField("NAME", s.Name).WithField("APPLIED", s.Applied).WithField("MISSING", s.Missing).Infoln("Migration status")
+		}
+	default:
+		err = fmt.Errorf("unknown migrate action: %s, should be one of up, down, to, status, baseline", action)
+	}
+
+	if err != nil {
+		return
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	outputData, err := json.Marshal(MigrateOutput{
+		Action:   action,
+		Version:  m.current(),
+		Migrated: migrated,
+		Status:   m.status(),
+	})
+
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: outputData, Tags: Tags})
+
+	return
+}
+
+func loadMigrations(dir string) (migrations []*migration, err error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	mapMigrations := map[int64]*migration{}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		matches := migrationFileRegexp.FindStringSubmatch(f.Name())
+		if matches == nil {
+			continue
+		}
+
+		var version int64
+		version, err = strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		m, exist := mapMigrations[version]
+		if !exist {
+			m = &migration{Version: version, Name: matches[2]}
+			mapMigrations[version] = m
+		} else if m.Name != matches[2] {
+			err = fmt.Errorf("conflict of migration version %d: %s and %s", version, m.Name, matches[2])
+			return
+		}
+
+		if matches[3] == "up" {
+			m.UpFile = filepath.Join(dir, f.Name())
+		} else {
+			m.DownFile = filepath.Join(dir, f.Name())
+		}
+	}
+
+	for _, m := range mapMigrations {
+		if len(m.UpFile) == 0 {
+			err = fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+			return
+		}
+
+		var data []byte
+		data, err = ioutil.ReadFile(m.UpFile)
+		if err != nil {
+			return
+		}
+
+		m.Checksum = fmt.Sprintf("%0x", sha256.Sum256(data))
+
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return
+}
+
+// prepare creates the tracking table, loads the applied versions and
+// verifies the checksum of applied migration files
+func (p *migrator) prepare() (err error) {
+
+	_, err = p.db.Exec(fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum VARCHAR(64) NOT NULL, applied_at VARCHAR(32) NOT NULL)",
+		p.table,
+	))
+
+	if err != nil {
+		return
+	}
+
+	rows, err := p.db.Query(fmt.Sprintf("SELECT version, name, checksum, applied_at FROM %s", p.table))
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	p.applied = map[int64]MigrationStatus{}
+
+	for rows.Next() {
+		s := MigrationStatus{Applied: true}
+		err = rows.Scan(&s.Version, &s.Name, &s.Checksum, &s.AppliedAt)
+		if err != nil {
+			return
+		}
+		p.applied[s.Version] = s
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, m := range p.migrations {
+		s, exist := p.applied[m.Version]
+		if exist && s.Checksum != m.Checksum {
+			err = fmt.Errorf("checksum of applied migration %d_%s was changed, applied: %s, current: %s", m.Version, m.Name, s.Checksum, m.Checksum)
+			return
+		}
+	}
+
+	return
+}
+
+func (p *migrator) current() (version int64) {
+	for v := range p.applied {
+		if v > version {
+			version = v
+		}
+	}
+	return
+}
+
+// up applies pending migrations in ascending order, stops after target
+// version if target > 0, or after n migrations if n > 0
+func (p *migrator) up(target int64, n int) (migrated []int64, err error) {
+
+	for _, m := range p.migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+
+		if n > 0 && len(migrated) >= n {
+			break
+		}
+
+		if _, exist := p.applied[m.Version]; exist {
+			continue
+		}
+
+		err = p.apply(m, true)
+		if err != nil {
+			return
+		}
+
+		migrated = append(migrated, m.Version)
+	}
+
+	return
+}
+
+// down reverts applied migrations in descending order, keeps the versions
+// <= target, or reverts n migrations if n > 0
+func (p *migrator) down(target int64, n int) (migrated []int64, err error) {
+
+	for i := len(p.migrations) - 1; i >= 0; i-- {
+		m := p.migrations[i]
+
+		if m.Version <= target {
+			break
+		}
+
+		if n > 0 && len(migrated) >= n {
+			break
+		}
+
+		if _, exist := p.applied[m.Version]; !exist {
+			continue
+		}
+
+		err = p.apply(m, false)
+		if err != nil {
+			return
+		}
+
+		migrated = append(migrated, m.Version)
+	}
+
+	return
+}
+
+// baseline marks the migrations <= version as applied without executing them
+func (p *migrator) baseline(version int64) (migrated []int64, err error) {
+
+	if version <= 0 {
+		err = fmt.Errorf("config of version could not be empty for baseline")
+		return
+	}
+
+	for _, m := range p.migrations {
+		if m.Version > version {
+			break
+		}
+
+		if _, exist := p.applied[m.Version]; exist {
+			continue
+		}
+
+		var tx *sql.Tx
+		tx, err = p.db.Begin()
+		if err != nil {
+			return
+		}
+
+		err = p.record(tx, m, true)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		if err = tx.Commit(); err != nil {
+			return
+		}
+
+		migrated = append(migrated, m.Version)
+	}
+
+	return
+}
+
+func (p *migrator) apply(m *migration, up bool) (err error) {
+
+	file := m.UpFile
+	direction := "up"
+
+	if !up {
+		file = m.DownFile
+		direction = "down"
+	}
+
+	if len(file) == 0 {
+		err = fmt.Errorf("migration %d_%s has no %s file", m.Version, m.Name, direction)
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	statements, err := splitSQL(string(data), p.driver.Dialect)
+	if err != nil {
+		err = fmt.Errorf("migration %s: %s", file, err)
+		return
+	}
+
+	logrus.WithField("VERSION", m.Version).WithField("NAME", m.Name).Infof("Migrating %s", direction)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("migration %s failure: %s", file, err)
+			return
+		}
+	}
+
+	err = p.record(tx, m, up)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (p *migrator) record(tx *sql.Tx, m *migration, applied bool) (err error) {
+
+	if !applied {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE version = %s", p.table, p.driver.Placeholder(1)), m.Version)
+		if err != nil {
+			return
+		}
+
+		delete(p.applied, m.Version)
+		return
+	}
+
+	s := MigrationStatus{
+		Version:   m.Version,
+		Name:      m.Name,
+		Checksum:  m.Checksum,
+		Applied:   true,
+		AppliedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	placeholders := make([]string, 4)
+	for i := range placeholders {
+		placeholders[i] = p.driver.Placeholder(i + 1)
+	}
+
+	_, err = tx.Exec(
+		fmt.Sprintf("INSERT INTO %s (version, name, checksum, applied_at) VALUES (%s)", p.table, strings.Join(placeholders, ", ")),
+		s.Version, s.Name, s.Checksum, s.AppliedAt,
+	)
+
+	if err != nil {
+		return
+	}
+
+	p.applied[m.Version] = s
+
+	return
+}
+
+func (p *migrator) status() (status []MigrationStatus) {
+
+	known := map[int64]bool{}
+
+	for _, m := range p.migrations {
+		known[m.Version] = true
+
+		s, exist := p.applied[m.Version]
+		if !exist {
+			s = MigrationStatus{Version: m.Version, Name: m.Name, Checksum: m.Checksum}
+		}
+
+		status = append(status, s)
+	}
+
+	for v, s := range p.applied {
+		if !known[v] {
+			s.Missing = true
+			status = append(status, s)
+		}
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return
+}
@@ -0,0 +1,225 @@
+package pwgen
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/gogap/config"
+	"github.com/sirupsen/logrus"
+)
+
+// sqlParams are bound through the placeholders of database/sql, positional
+// params are referenced by ? and named params by :name in sql
+type sqlParams struct {
+	positional []interface{}
+	named      map[string]interface{}
+	next       int
+}
+
+func newSQLParams(conf config.Configuration) *sqlParams {
+	params := &sqlParams{named: map[string]interface{}{}}
+
+	for _, v := range conf.GetStringList("params") {
+		params.positional = append(params.positional, v)
+	}
+
+	namedConf := conf.GetConfig("named-params")
+
+	if !namedConf.IsEmpty() {
+		for _, k := range namedConf.Keys() {
+			params.named[k] = namedConf.GetString(k)
+		}
+	}
+
+	return params
+}
+
+func (p *sqlParams) IsEmpty() bool {
+	return len(p.positional) == 0 && len(p.named) == 0
+}
+
+// Bind rewrites ? and :name in stmt to the placeholders of driver, positional
+// params are consumed in order, so they could be shared by several statements
+func (p *sqlParams) Bind(stmt string, driver sqlDriver) (string, []interface{}, error) {
+
+	if p.IsEmpty() {
+		return stmt, nil, nil
+	}
+
+	var (
+		buf  strings.Builder
+		args []interface{}
+	)
+
+	s := &sqlSplitter{script: stmt, dialect: driver.Dialect}
+
+	for s.pos < len(stmt) {
+		c := stmt[s.pos]
+		rest := stmt[s.pos:]
+
+		end := 1
+
+		switch {
+		case strings.HasPrefix(rest, "--") || (driver.Dialect.HashComment && c == '#'):
+			end = strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+		case strings.HasPrefix(rest, "/*"):
+			end = strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return "", nil, s.errorf("unterminated comment")
+			}
+			end += 4
+		case c == '\'' || c == '"' || (driver.Dialect.Backtick && c == '`'):
+			var err error
+			end, err = s.scanQuoted(c)
+			if err != nil {
+				return "", nil, err
+			}
+		case driver.Dialect.DollarQuote && c == '$':
+			if tag := s.dollarTag(); len(tag) > 0 {
+				end = strings.Index(rest[len(tag):], tag)
+				if end < 0 {
+					return "", nil, s.errorf("unterminated dollar quoted string %s", tag)
+				}
+				end += len(tag) * 2
+			}
+		case strings.HasPrefix(rest, "::"):
+			end = 2
+		case c == '?' && len(p.positional) > 0:
+			if p.next >= len(p.positional) {
+				return "", nil, s.errorf("not enough params, %d given", len(p.positional))
+			}
+			args = append(args, p.positional[p.next])
+			p.next++
+			buf.WriteString(driver.Placeholder(len(args)))
+			s.pos++
+			continue
+		case c == ':' && len(p.named) > 0 && len(rest) > 1 && isWordChar(rest[1]) && (s.pos == 0 || !isWordChar(stmt[s.pos-1])):
+			for end < len(rest) && isWordChar(rest[end]) {
+				end++
+			}
+			v, exist := p.named[rest[1:end]]
+			if !exist {
+				return "", nil, s.errorf("named param %s not found", rest[1:end])
+			}
+			args = append(args, v)
+			buf.WriteString(driver.Placeholder(len(args)))
+			s.pos += end
+			continue
+		}
+
+		buf.WriteString(rest[:end])
+		s.pos += end
+	}
+
+	return buf.String(), args, nil
+}
+
+// Done checks all positional params were consumed
+func (p *sqlParams) Done() error {
+	if p.next != len(p.positional) {
+		return fmt.Errorf("too many params, %d given but %d used", len(p.positional), p.next)
+	}
+	return nil
+}
+
+func templateFuncs(dialect sqlDialect) template.FuncMap {
+	return template.FuncMap{
+		"ident":   dialect.QuoteIdentifier,
+		"literal": dialect.QuoteLiteral,
+	}
+}
+
+// QuoteIdentifier quotes each part of name, e.g.: db.table -> `db`.`table`
+func (p sqlDialect) QuoteIdentifier(name string) string {
+	q := `"`
+	if p.Backtick {
+		q = "`"
+	}
+
+	parts := strings.Split(name, ".")
+	for i := range parts {
+		parts[i] = q + strings.Replace(parts[i], q, q+q, -1) + q
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func (p sqlDialect) QuoteLiteral(value string) string {
+	if p.BackslashEscape {
+		value = strings.Replace(value, `\`, `\\`, -1)
+	}
+
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// lintTemplate warns the template actions inside of string literals, the
+// values should be passed by params
+func lintTemplate(text string, dialect sqlDialect) {
+
+	s := &sqlSplitter{script: text, dialect: dialect}
+
+	for s.pos < len(text) {
+		c := text[s.pos]
+		rest := text[s.pos:]
+
+		switch {
+		case strings.HasPrefix(rest, "{{"):
+			end := strings.Index(rest, "}}")
+			if end < 0 {
+				return
+			}
+			s.pos += end + 2
+		case strings.HasPrefix(rest, "--") || (dialect.HashComment && c == '#'):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				return
+			}
+			s.pos += end
+		case c == '\'' || c == '"':
+			end, err := s.scanQuoted(c)
+			if err != nil {
+				return
+			}
+
+			// double quoted is identifier except mysql dialect
+			isLiteral := c == '\'' || dialect.Backtick
+
+			if isLiteral && strings.Contains(rest[:end], "{{") {
+				line := strings.Count(text[:s.pos], "\n") + 1
+				logrus.WithField("LINE", line).WithField("LITERAL", rest[:end]).
+					Warnln("Template value inside of sql string literal, use params or literal instead")
+			}
+
+			s.pos += end
+		default:
+			s.pos++
+		}
+	}
+}
+
+// quoteConfigKey quotes the table name as a key of config, so the
+// schema-qualified name, e.g. public.users, is not read as a path
+func quoteConfigKey(table string) string {
+	return `"` + strings.Replace(table, `"`, `\"`, -1) + `"`
+}
+
+// checkTableKeys reports the keys of conf which are not in tables, the key
+// of unquoted schema-qualified name, e.g. public.users, is read as public
+func checkTableKeys(conf config.Configuration, name string, tables []string) error {
+
+	if conf.IsEmpty() {
+		return nil
+	}
+
+	for _, key := range conf.Keys() {
+		if !containsString(tables, key) {
+			return fmt.Errorf("%s.%s is not in tables, the schema-qualified name should be quoted, e.g. %s.\"public.users\"", name, key, name)
+		}
+	}
+
+	return nil
+}
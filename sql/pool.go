@@ -0,0 +1,135 @@
+package pwgen
+
+import (
+	goctx "context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flow-contrib/toolkit/utils/secret"
+	"github.com/gogap/context"
+	"github.com/sirupsen/logrus"
+)
+
+const maxConnectRetryInterval = time.Second * 30
+
+type dbCacheKey struct{}
+
+// dbCache keeps the opened handles in flow context, the steps with the same
+// driver and dsn share one connection pool
+type dbCache struct {
+	sync.Mutex
+	handles map[string]*sql.DB
+}
+
+var dbCacheLocker sync.Mutex
+
+func getDBCache(ctx context.Context) *dbCache {
+	dbCacheLocker.Lock()
+	defer dbCacheLocker.Unlock()
+
+	if cache, ok := ctx.Value(dbCacheKey{}).(*dbCache); ok {
+		return cache
+	}
+
+	cache := &dbCache{handles: map[string]*sql.DB{}}
+	ctx.WithValue(dbCacheKey{}, cache)
+
+	return cache
+}
+
+// Connect returns the cached handle of flow context, or opens a new one, the
+// handle should not be closed by handlers
+func (p *sqlConfig) Connect(ctx context.Context) (db *sql.DB, err error) {
+	p.Password, err = secret.Resolve(ctx, p.conf, "password")
+	if err != nil {
+		return
+	}
+
+	driverName, err := p.DriverName()
+	if err != nil {
+		return
+	}
+
+	dsn, err := p.DataSourceName()
+	if err != nil {
+		return
+	}
+
+	cache := getDBCache(ctx)
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	key := driverName + "|" + dsn
+
+	if db = cache.handles[key]; db != nil {
+		return
+	}
+
+	db, err = sql.Open(driverName, dsn)
+	if err != nil {
+		return
+	}
+
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+
+	if err = p.ping(db); err != nil {
+		db.Close()
+		db = nil
+		return
+	}
+
+	cache.handles[key] = db
+
+	return
+}
+
+// ping waits for the database, it retries with exponential backoff while the
+// database is still starting up
+func (p *sqlConfig) ping(db *sql.DB) (err error) {
+
+	interval := p.ConnectRetryInterval
+
+	for attempt := 0; ; attempt++ {
+
+		c, cancel := goctx.Background(), goctx.CancelFunc(func() {})
+
+		if p.ConnectTimeout > 0 {
+			c, cancel = goctx.WithTimeout(c, p.ConnectTimeout)
+		}
+
+		err = db.PingContext(c)
+		cancel()
+
+		if err == nil {
+			return
+		}
+
+		if attempt >= p.ConnectRetries {
+			err = fmt.Errorf("connect to %s database at %s failure after %d attempts: %s", p.Driver, p.Host, attempt+1, err)
+			return
+		}
+
+		logrus.WithField("DRIVER", p.Driver).WithField("HOST", p.Host).WithField("ATTEMPT", attempt+1).WithField("ERROR", err.Error()).Warnln("Waiting for database")
+
+		time.Sleep(interval)
+
+		if interval *= 2; interval > maxConnectRetryInterval {
+			interval = maxConnectRetryInterval
+		}
+	}
+}
+
+// resetSession restores the session settings before the connection goes
+// back to the pool, so the next step will not inherit the timeouts
+func resetSession(c goctx.Context, conn *sql.Conn, driver sqlDriver) {
+	for _, stmt := range driver.ResetSettings {
+		if _, err := conn.ExecContext(c, stmt); err != nil {
+			logrus.WithField("SQL", stmt).WithField("ERROR", err.Error()).Warnln("Reset session failure")
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package pwgen
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type queryResult struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// resultRow marshals to json object with the order of columns
+type resultRow struct {
+	columns []string
+	values  []interface{}
+}
+
+func (p resultRow) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte('{')
+
+	for i, col := range p.columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(col)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(p.values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+type ColumnSchema struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable *bool  `json:"nullable,omitempty"`
+}
+
+// rowScanner scans the rows into typed values by the database type of columns
+type rowScanner struct {
+	Columns []string
+	Schema  []ColumnSchema
+	types   []string
+}
+
+func newRowScanner(rows *sql.Rows, columnCase string) (*rowScanner, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := &rowScanner{}
+
+	for _, ct := range columnTypes {
+		name := convertColumnCase(ct.Name(), columnCase)
+		dbType := strings.ToUpper(ct.DatabaseTypeName())
+
+		schema := ColumnSchema{Name: name, Type: dbType}
+		if nullable, ok := ct.Nullable(); ok {
+			schema.Nullable = &nullable
+		}
+
+		scanner.Columns = append(scanner.Columns, name)
+		scanner.Schema = append(scanner.Schema, schema)
+		scanner.types = append(scanner.types, dbType)
+	}
+
+	return scanner, nil
+}
+
+func (p *rowScanner) Scan(rows *sql.Rows) ([]interface{}, error) {
+	values := make([]interface{}, len(p.Columns))
+	ptrs := make([]interface{}, len(p.Columns))
+
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	for i := range values {
+		values[i] = convertValue(values[i], p.types[i])
+	}
+
+	return values, nil
+}
+
+func convertValue(v interface{}, dbType string) interface{} {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case []byte:
+		return convertText(string(value), dbType)
+	case string:
+		return convertText(value, dbType)
+	}
+
+	return v
+}
+
+// convertText converts the text protocol values, e.g.: mysql returns []byte for all columns
+func convertText(s string, dbType string) interface{} {
+	switch {
+	case strings.Contains(dbType, "INT") && !strings.Contains(dbType, "INTERVAL"):
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return u
+		}
+	case dbType == "DECIMAL" || dbType == "NUMERIC":
+		// keep the precision
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case strings.Contains(dbType, "FLOAT") || strings.Contains(dbType, "DOUBLE") || dbType == "REAL":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case dbType == "BOOL" || dbType == "BOOLEAN" || dbType == "BIT":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case dbType == "JSON" || dbType == "JSONB":
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+	}
+
+	return s
+}
+
+func convertColumnCase(name, columnCase string) string {
+	switch columnCase {
+	case "lower":
+		return strings.ToLower(name)
+	case "upper":
+		return strings.ToUpper(name)
+	case "camel":
+		parts := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == ' ' })
+		for i := range parts {
+			if i == 0 {
+				parts[i] = strings.ToLower(parts[i])
+				continue
+			}
+			runes := []rune(strings.ToLower(parts[i]))
+			runes[0] = unicode.ToUpper(runes[0])
+			parts[i] = string(runes)
+		}
+		return strings.Join(parts, "")
+	}
+
+	return name
+}
+
+func queryAll(db *sql.DB, columnCase string, query string, args ...interface{}) (result *queryResult, err error) {
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	scanner, err := newRowScanner(rows, columnCase)
+	if err != nil {
+		return
+	}
+
+	result = &queryResult{Columns: scanner.Columns}
+
+	for rows.Next() {
+		var values []interface{}
+		values, err = scanner.Scan(rows)
+		if err != nil {
+			return
+		}
+		result.Rows = append(result.Rows, values)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (p *queryResult) row(i int) resultRow {
+	return resultRow{columns: p.Columns, values: p.Rows[i]}
+}
+
+// Scalar returns the only value of result
+func (p *queryResult) Scalar() (interface{}, error) {
+	if len(p.Columns) != 1 {
+		return nil, fmt.Errorf("scalar query should return exactly one column, but got %d", len(p.Columns))
+	}
+
+	if len(p.Rows) > 1 {
+		return nil, fmt.Errorf("scalar query should return at most one row, but got %d", len(p.Rows))
+	}
+
+	if len(p.Rows) == 0 {
+		return nil, nil
+	}
+
+	return p.Rows[0][0], nil
+}
+
+// SingleRow returns the only row of result
+func (p *queryResult) SingleRow() (interface{}, error) {
+	if len(p.Rows) > 1 {
+		return nil, fmt.Errorf("single-row query should return at most one row, but got %d", len(p.Rows))
+	}
+
+	if len(p.Rows) == 0 {
+		return nil, nil
+	}
+
+	return p.row(0), nil
+}
+
+func (p *queryResult) Render(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		rows := make([]resultRow, len(p.Rows))
+		for i := range p.Rows {
+			rows[i] = p.row(i)
+		}
+		return json.Marshal(rows)
+	case "ndjson":
+		buf := bytes.NewBuffer(nil)
+		for i := range p.Rows {
+			line, err := json.Marshal(p.row(i))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	case "csv", "tsv":
+		buf := bytes.NewBuffer(nil)
+		w := csv.NewWriter(buf)
+		if format == "tsv" {
+			w.Comma = '\t'
+		}
+		w.Write(p.Columns)
+		for _, row := range p.Rows {
+			w.Write(formatTextRow(row))
+		}
+		w.Flush()
+		return buf.Bytes(), w.Error()
+	case "markdown-table":
+		buf := bytes.NewBuffer(nil)
+		writeMarkdownRow(buf, p.Columns)
+		separator := make([]string, len(p.Columns))
+		for i := range separator {
+			separator[i] = "---"
+		}
+		writeMarkdownRow(buf, separator)
+		for _, row := range p.Rows {
+			writeMarkdownRow(buf, formatTextRow(row))
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported output format: %s, should be one of json, csv, tsv, ndjson, markdown-table", format)
+}
+
+func formatTextRow(row []interface{}) []string {
+	items := make([]string, len(row))
+	for i, v := range row {
+		items[i] = formatTextValue(v)
+	}
+	return items
+}
+
+func formatTextValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.RawMessage:
+		return string(value)
+	}
+
+	return fmt.Sprint(v)
+}
+
+func writeMarkdownRow(buf *bytes.Buffer, items []string) {
+	buf.WriteString("|")
+	for _, item := range items {
+		item = strings.Replace(item, "|", `\|`, -1)
+		item = strings.Replace(item, "\n", "<br>", -1)
+		buf.WriteString(" " + item + " |")
+	}
+	buf.WriteString("\n")
+}
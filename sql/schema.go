@@ -0,0 +1,696 @@
+package pwgen
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+)
+
+type SchemaModel struct {
+	Driver string        `json:"driver"`
+	Tables []TableSchema `json:"tables"`
+}
+
+type TableSchema struct {
+	Name        string          `json:"name"`
+	Columns     []ColumnDef     `json:"columns"`
+	Indexes     []IndexDef      `json:"indexes,omitempty"`
+	ForeignKeys []ForeignKeyDef `json:"foreign_keys,omitempty"`
+}
+
+type ColumnDef struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default,omitempty"`
+	// e.g.: AUTO_INCREMENT or ON UPDATE CURRENT_TIMESTAMP of mysql
+	Extra string `json:"extra,omitempty"`
+}
+
+type IndexDef struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+	Primary bool     `json:"primary"`
+}
+
+type ForeignKeyDef struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.schema.inspect", SchemaInspect)
+}
+
+func SchemaInspect(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	model, err := inspectSchemaByConfig(ctx, conf)
+	if err != nil {
+		return
+	}
+
+	data, err := json.MarshalIndent(model, "", "    ")
+	if err != nil {
+		return
+	}
+
+	outputFile := conf.GetString("output.file")
+
+	if len(outputFile) > 0 {
+		err = ioutil.WriteFile(outputFile, data, 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) > 0 {
+		flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+	}
+
+	return
+}
+
+// inspectSchemaByConfig loads the model from a snapshot file if config of
+// snapshot is set, otherwise reads it from database
+func inspectSchemaByConfig(ctx context.Context, conf config.Configuration) (model *SchemaModel, err error) {
+
+	tables := conf.GetStringList("tables")
+
+	if snapshot := conf.GetString("snapshot"); len(snapshot) > 0 {
+		var data []byte
+		data, err = ioutil.ReadFile(snapshot)
+		if err != nil {
+			return
+		}
+
+		model = &SchemaModel{}
+		if err = json.Unmarshal(data, model); err != nil {
+			err = fmt.Errorf("parse schema snapshot %s failure: %s", snapshot, err)
+			return
+		}
+
+		model.filter(tables)
+
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	return inspectSchema(db, driver, conf.GetString("schema"), tables)
+}
+
+func inspectSchema(db *sql.DB, driver sqlDriver, schema string, tables []string) (model *SchemaModel, err error) {
+
+	inspector := &schemaInspector{db: db, tables: map[string]*TableSchema{}}
+
+	switch driver.Name {
+	case "mysql":
+		err = inspector.mysql()
+	case "postgres":
+		if len(schema) == 0 {
+			schema = "public"
+		}
+		err = inspector.postgres(schema)
+	case "sqlite3":
+		err = inspector.sqlite()
+	default:
+		err = fmt.Errorf("schema inspect is not supported by driver %s", driver.Name)
+	}
+
+	if err != nil {
+		return
+	}
+
+	model = &SchemaModel{Driver: driver.Name}
+
+	for _, table := range inspector.tables {
+		model.Tables = append(model.Tables, *table)
+	}
+
+	model.normalize()
+	model.filter(tables)
+
+	return
+}
+
+func (p *SchemaModel) normalize() {
+	sort.Slice(p.Tables, func(i, j int) bool { return p.Tables[i].Name < p.Tables[j].Name })
+
+	for i := range p.Tables {
+		t := &p.Tables[i]
+		sort.Slice(t.Indexes, func(i, j int) bool { return t.Indexes[i].Name < t.Indexes[j].Name })
+		sort.Slice(t.ForeignKeys, func(i, j int) bool { return t.ForeignKeys[i].Name < t.ForeignKeys[j].Name })
+	}
+}
+
+func (p *SchemaModel) filter(tables []string) {
+	if len(tables) == 0 {
+		return
+	}
+
+	keep := map[string]bool{}
+	for _, t := range tables {
+		keep[t] = true
+	}
+
+	var filtered []TableSchema
+	for _, t := range p.Tables {
+		if keep[t.Name] {
+			filtered = append(filtered, t)
+		}
+	}
+
+	p.Tables = filtered
+}
+
+func (p *SchemaModel) Table(name string) *TableSchema {
+	for i := range p.Tables {
+		if p.Tables[i].Name == name {
+			return &p.Tables[i]
+		}
+	}
+	return nil
+}
+
+func (p *TableSchema) Column(name string) *ColumnDef {
+	for i := range p.Columns {
+		if p.Columns[i].Name == name {
+			return &p.Columns[i]
+		}
+	}
+	return nil
+}
+
+func (p *TableSchema) Index(name string) *IndexDef {
+	for i := range p.Indexes {
+		if p.Indexes[i].Name == name {
+			return &p.Indexes[i]
+		}
+	}
+	return nil
+}
+
+func (p *TableSchema) ForeignKey(name string) *ForeignKeyDef {
+	for i := range p.ForeignKeys {
+		if p.ForeignKeys[i].Name == name {
+			return &p.ForeignKeys[i]
+		}
+	}
+	return nil
+}
+
+func (p *TableSchema) PrimaryKey() *IndexDef {
+	for i := range p.Indexes {
+		if p.Indexes[i].Primary {
+			return &p.Indexes[i]
+		}
+	}
+	return nil
+}
+
+func (p ColumnDef) Definition(dialect sqlDialect) string {
+	def := dialect.QuoteIdentifier(p.Name) + " " + p.Type
+
+	if !p.Nullable {
+		def += " NOT NULL"
+	}
+
+	if p.Default != nil {
+		def += " DEFAULT " + *p.Default
+	}
+
+	if len(p.Extra) > 0 {
+		def += " " + p.Extra
+	}
+
+	return def
+}
+
+// CreateTableDDL builds the DDL with columns and primary key
+func (p *TableSchema) CreateTableDDL(dialect sqlDialect) string {
+	var items []string
+
+	for _, col := range p.Columns {
+		items = append(items, "    "+col.Definition(dialect))
+	}
+
+	if pk := p.PrimaryKey(); pk != nil {
+		items = append(items, "    PRIMARY KEY ("+quoteIdentifiers(dialect, pk.Columns)+")")
+	}
+
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n)", dialect.QuoteIdentifier(p.Name), strings.Join(items, ",\n"))
+}
+
+func quoteIdentifiers(dialect sqlDialect, names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = dialect.QuoteIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+type schemaInspector struct {
+	db     *sql.DB
+	tables map[string]*TableSchema
+}
+
+func (p *schemaInspector) table(name string) *TableSchema {
+	t, exist := p.tables[name]
+	if !exist {
+		t = &TableSchema{Name: name}
+		p.tables[name] = t
+	}
+	return t
+}
+
+// index appends column to the index, the rows should be ordered by the position in index
+func (p *schemaInspector) index(table, name, column string, unique, primary bool) {
+	t := p.table(table)
+
+	idx := t.Index(name)
+	if idx == nil {
+		t.Indexes = append(t.Indexes, IndexDef{Name: name, Unique: unique, Primary: primary})
+		idx = &t.Indexes[len(t.Indexes)-1]
+	}
+
+	idx.Columns = append(idx.Columns, column)
+}
+
+func (p *schemaInspector) foreignKey(table, name, column, refTable, refColumn string) {
+	t := p.table(table)
+
+	fk := t.ForeignKey(name)
+	if fk == nil {
+		t.ForeignKeys = append(t.ForeignKeys, ForeignKeyDef{Name: name, RefTable: refTable})
+		fk = &t.ForeignKeys[len(t.ForeignKeys)-1]
+	}
+
+	fk.Columns = append(fk.Columns, column)
+	fk.RefColumns = append(fk.RefColumns, refColumn)
+}
+
+func (p *schemaInspector) columns(query string, args ...interface{}) (err error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			table, nullable string
+			col             ColumnDef
+			def             sql.NullString
+		)
+
+		if err = rows.Scan(&table, &col.Name, &col.Type, &nullable, &def, &col.Extra); err != nil {
+			return
+		}
+
+		col.Nullable = nullable == "YES" || nullable == "true" || nullable == "1"
+
+		if def.Valid {
+			col.Default = &def.String
+		}
+
+		t := p.table(table)
+		t.Columns = append(t.Columns, col)
+	}
+
+	return rows.Err()
+}
+
+func (p *schemaInspector) mysql() (err error) {
+
+	err = p.columns(`SELECT table_name, column_name, column_type, is_nullable, column_default, extra
+FROM information_schema.columns WHERE table_schema = DATABASE() ORDER BY table_name, ordinal_position`)
+	if err != nil {
+		return
+	}
+
+	for _, t := range p.tables {
+		for i := range t.Columns {
+			col := &t.Columns[i]
+			if col.Default != nil {
+				def := mysqlColumnDefault(*col.Default, col.Extra)
+				col.Default = &def
+			}
+			col.Extra = mysqlColumnExtra(col.Extra)
+		}
+	}
+
+	rows, err := p.db.Query(`SELECT table_name, index_name, column_name, non_unique
+FROM information_schema.statistics WHERE table_schema = DATABASE() ORDER BY table_name, index_name, seq_in_index`)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, name, column string
+		var nonUnique int
+		if err = rows.Scan(&table, &name, &column, &nonUnique); err != nil {
+			return
+		}
+		p.index(table, name, column, nonUnique == 0, name == "PRIMARY")
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	fkRows, err := p.db.Query(`SELECT table_name, constraint_name, column_name, referenced_table_name, referenced_column_name
+FROM information_schema.key_column_usage WHERE table_schema = DATABASE() AND referenced_table_name IS NOT NULL
+ORDER BY table_name, constraint_name, ordinal_position`)
+	if err != nil {
+		return
+	}
+
+	defer fkRows.Close()
+
+	for fkRows.Next() {
+		var table, name, column, refTable, refColumn string
+		if err = fkRows.Scan(&table, &name, &column, &refTable, &refColumn); err != nil {
+			return
+		}
+		p.foreignKey(table, name, column, refTable, refColumn)
+	}
+
+	return fkRows.Err()
+}
+
+func (p *schemaInspector) postgres(schema string) (err error) {
+
+	err = p.columns(`SELECT c.relname, a.attname, format_type(a.atttypid, a.atttypmod), CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END, pg_get_expr(d.adbin, d.adrelid), ''
+FROM pg_attribute a
+JOIN pg_class c ON c.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE n.nspname = $1 AND c.relkind = 'r' AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY c.relname, a.attnum`, schema)
+	if err != nil {
+		return
+	}
+
+	rows, err := p.db.Query(`SELECT t.relname, i.relname, a.attname, ix.indisunique, ix.indisprimary
+FROM pg_index ix
+JOIN pg_class t ON t.oid = ix.indrelid
+JOIN pg_class i ON i.oid = ix.indexrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+WHERE n.nspname = $1
+ORDER BY t.relname, i.relname, k.ord`, schema)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, name, column string
+		var unique, primary bool
+		if err = rows.Scan(&table, &name, &column, &unique, &primary); err != nil {
+			return
+		}
+		p.index(table, name, column, unique, primary)
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	fkRows, err := p.db.Query(`SELECT t.relname, c.conname, a.attname, rt.relname, ra.attname
+FROM pg_constraint c
+JOIN pg_class t ON t.oid = c.conrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+JOIN pg_class rt ON rt.oid = c.confrelid
+JOIN LATERAL unnest(c.conkey, c.confkey) WITH ORDINALITY AS k(attnum, refnum, ord) ON true
+JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+JOIN pg_attribute ra ON ra.attrelid = c.confrelid AND ra.attnum = k.refnum
+WHERE c.contype = 'f' AND n.nspname = $1
+ORDER BY t.relname, c.conname, k.ord`, schema)
+	if err != nil {
+		return
+	}
+
+	defer fkRows.Close()
+
+	for fkRows.Next() {
+		var table, name, column, refTable, refColumn string
+		if err = fkRows.Scan(&table, &name, &column, &refTable, &refColumn); err != nil {
+			return
+		}
+		p.foreignKey(table, name, column, refTable, refColumn)
+	}
+
+	return fkRows.Err()
+}
+
+// mysqlColumnDefault returns the default as it is written in ddl, the string
+// literals are returned unquoted by mysql, but expressions are not quoted
+func mysqlColumnDefault(def, extra string) string {
+
+	upper := strings.ToUpper(def)
+
+	switch {
+	// mariadb returns the quoted literals
+	case strings.HasPrefix(def, "'"), strings.HasPrefix(upper, "B'"), strings.HasPrefix(upper, "X'"):
+		return def
+	case upper == "NULL", strings.HasPrefix(upper, "CURRENT_TIMESTAMP"), strings.HasPrefix(upper, "NOW("), strings.HasPrefix(upper, "LOCALTIMESTAMP"):
+		return def
+	case strings.Contains(extra, "DEFAULT_GENERATED"):
+		// the expression default of mysql 8.0.13+
+		return "(" + def + ")"
+	}
+
+	return mysqlDialect.QuoteLiteral(def)
+}
+
+// mysqlColumnExtra keeps the attributes of extra which are part of column
+// definition, e.g.: auto_increment and on update CURRENT_TIMESTAMP
+func mysqlColumnExtra(extra string) string {
+
+	var items []string
+
+	lower := strings.ToLower(extra)
+
+	if strings.Contains(lower, "auto_increment") {
+		items = append(items, "AUTO_INCREMENT")
+	}
+
+	if i := strings.Index(lower, "on update "); i >= 0 {
+		items = append(items, "ON UPDATE "+strings.TrimSpace(extra[i+len("on update "):]))
+	}
+
+	return strings.Join(items, " ")
+}
+
+func (p *schemaInspector) sqlite() (err error) {
+
+	rows, err := p.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return
+	}
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return
+		}
+		names = append(names, name)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, name := range names {
+		if err = p.sqliteTable(name); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (p *schemaInspector) sqliteTable(name string) (err error) {
+
+	quoted := genericDialect.QuoteIdentifier(name)
+
+	t := p.table(name)
+
+	rows, err := p.db.Query("PRAGMA table_info(" + quoted + ")")
+	if err != nil {
+		return
+	}
+
+	var pk []string
+	pkPos := map[string]int{}
+
+	for rows.Next() {
+		var (
+			cid, notNull, pkIndex int
+			col                   ColumnDef
+			def                   sql.NullString
+		)
+
+		if err = rows.Scan(&cid, &col.Name, &col.Type, &notNull, &def, &pkIndex); err != nil {
+			rows.Close()
+			return
+		}
+
+		col.Nullable = notNull == 0
+		if def.Valid {
+			col.Default = &def.String
+		}
+
+		if pkIndex > 0 {
+			pk = append(pk, col.Name)
+			pkPos[col.Name] = pkIndex
+		}
+
+		t.Columns = append(t.Columns, col)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(pk) > 0 {
+		sort.Slice(pk, func(i, j int) bool { return pkPos[pk[i]] < pkPos[pk[j]] })
+		t.Indexes = append(t.Indexes, IndexDef{Name: "PRIMARY", Columns: pk, Unique: true, Primary: true})
+	}
+
+	indexRows, err := p.db.Query("PRAGMA index_list(" + quoted + ")")
+	if err != nil {
+		return
+	}
+
+	type sqliteIndex struct {
+		name   string
+		unique bool
+		origin string
+	}
+
+	var indexes []sqliteIndex
+
+	cols, err := indexRows.Columns()
+	if err != nil {
+		indexRows.Close()
+		return
+	}
+
+	for indexRows.Next() {
+		// seq, name, unique, origin, partial
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+
+		if err = indexRows.Scan(ptrs...); err != nil {
+			indexRows.Close()
+			return
+		}
+
+		idx := sqliteIndex{name: formatTextValue(convertValue(values[1], "")), unique: formatTextValue(convertValue(values[2], "")) == "1"}
+		if len(values) > 3 {
+			idx.origin = formatTextValue(convertValue(values[3], ""))
+		}
+
+		indexes = append(indexes, idx)
+	}
+
+	indexRows.Close()
+
+	if err = indexRows.Err(); err != nil {
+		return
+	}
+
+	for _, idx := range indexes {
+		// the primary key was read from table_info
+		if idx.origin == "pk" {
+			continue
+		}
+
+		var infoRows *sql.Rows
+		infoRows, err = p.db.Query("PRAGMA index_info(" + genericDialect.QuoteIdentifier(idx.name) + ")")
+		if err != nil {
+			return
+		}
+
+		for infoRows.Next() {
+			var seqno, cid int
+			var column sql.NullString
+			if err = infoRows.Scan(&seqno, &cid, &column); err != nil {
+				infoRows.Close()
+				return
+			}
+			p.index(name, idx.name, column.String, idx.unique, false)
+		}
+
+		infoRows.Close()
+
+		if err = infoRows.Err(); err != nil {
+			return
+		}
+	}
+
+	fkRows, err := p.db.Query("PRAGMA foreign_key_list(" + quoted + ")")
+	if err != nil {
+		return
+	}
+
+	defer fkRows.Close()
+
+	for fkRows.Next() {
+		var (
+			id, seq                                   int
+			refTable, from, onUpdate, onDelete, match string
+			to                                        sql.NullString
+		)
+
+		if err = fkRows.Scan(&id, &seq, &refTable, &from, &to, &onUpdate, &onDelete, &match); err != nil {
+			return
+		}
+
+		p.foreignKey(name, fmt.Sprintf("fk_%s_%d", name, id), from, refTable, to.String)
+	}
+
+	return fkRows.Err()
+}
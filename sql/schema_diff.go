@@ -0,0 +1,412 @@
+package pwgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type SchemaChange struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Name   string `json:"name,omitempty"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	DDL    string `json:"ddl,omitempty"`
+}
+
+func (p SchemaChange) String() string {
+	name := p.Table
+	if len(p.Name) > 0 {
+		name += "." + p.Name
+	}
+
+	switch p.Action {
+	case "add":
+		return fmt.Sprintf("+ %s %s", p.Kind, name)
+	case "drop":
+		return fmt.Sprintf("- %s %s", p.Kind, name)
+	}
+
+	return fmt.Sprintf("~ %s %s: %s -> %s", p.Kind, name, p.From, p.To)
+}
+
+type SchemaDiffOutput struct {
+	Equal   bool           `json:"equal"`
+	Changes []SchemaChange `json:"changes"`
+	Text    string         `json:"text"`
+	DDL     string         `json:"ddl,omitempty"`
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.schema.diff", SchemaDiff)
+}
+
+// SchemaDiff compares schema of 'from' and 'to', the generated ddl migrates 'from' to 'to'
+func SchemaDiff(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	fromConf := conf.GetConfig("from")
+	toConf := conf.GetConfig("to")
+
+	if fromConf.IsEmpty() || toConf.IsEmpty() {
+		err = fmt.Errorf("config of from and to could not be empty")
+		return
+	}
+
+	from, err := inspectSchemaByConfig(ctx, fromConf)
+	if err != nil {
+		return
+	}
+
+	to, err := inspectSchemaByConfig(ctx, toConf)
+	if err != nil {
+		return
+	}
+
+	tables := conf.GetStringList("tables")
+	from.filter(tables)
+	to.filter(tables)
+
+	var ddlDriver *sqlDriver
+
+	if conf.GetBoolean("ddl", false) {
+		driver, exist := drivers[from.Driver]
+		if !exist {
+			err = fmt.Errorf("unknown driver of schema: %s", from.Driver)
+			return
+		}
+		ddlDriver = &driver
+	}
+
+	changes := diffSchema(from, to, ddlDriver)
+
+	output := SchemaDiffOutput{Equal: len(changes) == 0, Changes: changes}
+
+	var lines, ddls []string
+	for _, change := range changes {
+		lines = append(lines, change.String())
+		if len(change.DDL) > 0 {
+			ddls = append(ddls, change.DDL+";")
+		}
+	}
+
+	output.Text = strings.Join(lines, "\n")
+	output.DDL = strings.Join(ddls, "\n")
+
+	if output.Equal {
+		logrus.Infoln("Schemas are equal")
+	} else {
+		logrus.WithField("CHANGES", len(changes)).Infof("Schemas are different:\n%s\n", output.Text)
+	}
+
+	if ddlFile := conf.GetString("output.ddl-file"); len(ddlFile) > 0 {
+		err = ioutil.WriteFile(ddlFile, []byte(output.DDL+"\n"), 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) > 0 {
+		var data []byte
+		data, err = json.Marshal(output)
+		if err != nil {
+			return
+		}
+
+		flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+	}
+
+	if !output.Equal && conf.GetBoolean("fail-on-diff", false) {
+		err = fmt.Errorf("schemas are different:\n%s", output.Text)
+		return
+	}
+
+	return
+}
+
+// diffSchema lists the changes from 'from' to 'to', the ddl of changes will
+// be generated if driver is not nil. The foreign keys are dropped before any
+// table and added after all tables and columns, so the referenced tables
+// exist regardless of the order of tables
+func diffSchema(from, to *SchemaModel, driver *sqlDriver) (changes []SchemaChange) {
+
+	ddl := &ddlGenerator{driver: driver}
+
+	var tableChanges, addForeignKeys []SchemaChange
+
+	for i := range from.Tables {
+		fromTable := &from.Tables[i]
+
+		toTable := to.Table(fromTable.Name)
+		if toTable == nil {
+			// the foreign keys of dropped table may reference another dropped table
+			for _, fk := range fromTable.ForeignKeys {
+				changes = append(changes, SchemaChange{Action: "drop", Kind: "foreign key", Table: fromTable.Name, Name: fk.Name, DDL: ddl.dropForeignKey(fromTable.Name, fk)})
+			}
+			continue
+		}
+
+		drops, adds := diffForeignKeys(fromTable, toTable, ddl)
+		changes = append(changes, drops...)
+		addForeignKeys = append(addForeignKeys, adds...)
+	}
+
+	for _, fromTable := range from.Tables {
+		if to.Table(fromTable.Name) == nil {
+			changes = append(changes, SchemaChange{Action: "drop", Kind: "table", Table: fromTable.Name, DDL: ddl.dropTable(fromTable)})
+		}
+	}
+
+	for i := range to.Tables {
+		toTable := &to.Tables[i]
+
+		fromTable := from.Table(toTable.Name)
+		if fromTable == nil {
+			tableChanges = append(tableChanges, SchemaChange{Action: "add", Kind: "table", Table: toTable.Name, DDL: ddl.createTable(toTable)})
+
+			for _, idx := range toTable.Indexes {
+				if !idx.Primary {
+					tableChanges = append(tableChanges, SchemaChange{Action: "add", Kind: "index", Table: toTable.Name, Name: idx.Name, DDL: ddl.createIndex(toTable.Name, idx)})
+				}
+			}
+
+			for _, fk := range toTable.ForeignKeys {
+				addForeignKeys = append(addForeignKeys, SchemaChange{Action: "add", Kind: "foreign key", Table: toTable.Name, Name: fk.Name, DDL: ddl.addForeignKey(toTable.Name, fk)})
+			}
+
+			continue
+		}
+
+		tableChanges = append(tableChanges, diffTable(fromTable, toTable, ddl)...)
+	}
+
+	changes = append(changes, tableChanges...)
+	changes = append(changes, addForeignKeys...)
+
+	return
+}
+
+// diffForeignKeys lists the foreign keys to drop and to add of the table
+// existing in both schemas, the changed one is dropped and added again
+func diffForeignKeys(from, to *TableSchema, ddl *ddlGenerator) (drops, adds []SchemaChange) {
+
+	table := to.Name
+
+	for _, fk := range from.ForeignKeys {
+		if toFK := to.ForeignKey(fk.Name); toFK == nil || !reflect.DeepEqual(fk, *toFK) {
+			drops = append(drops, SchemaChange{Action: "drop", Kind: "foreign key", Table: table, Name: fk.Name, DDL: ddl.dropForeignKey(table, fk)})
+		}
+	}
+
+	for _, fk := range to.ForeignKeys {
+		if fromFK := from.ForeignKey(fk.Name); fromFK == nil || !reflect.DeepEqual(*fromFK, fk) {
+			adds = append(adds, SchemaChange{Action: "add", Kind: "foreign key", Table: table, Name: fk.Name, DDL: ddl.addForeignKey(table, fk)})
+		}
+	}
+
+	return
+}
+
+// diffTable lists the changes of indexes and columns, the foreign keys are
+// listed by diffForeignKeys
+func diffTable(from, to *TableSchema, ddl *ddlGenerator) (changes []SchemaChange) {
+
+	table := to.Name
+
+	// indexes are dropped before columns
+	for _, idx := range from.Indexes {
+		if toIdx := to.Index(idx.Name); toIdx == nil || !reflect.DeepEqual(idx, *toIdx) {
+			changes = append(changes, SchemaChange{Action: "drop", Kind: "index", Table: table, Name: idx.Name, DDL: ddl.dropIndex(table, idx)})
+		}
+	}
+
+	for _, col := range from.Columns {
+		if to.Column(col.Name) == nil {
+			changes = append(changes, SchemaChange{Action: "drop", Kind: "column", Table: table, Name: col.Name, DDL: ddl.dropColumn(table, col)})
+		}
+	}
+
+	for _, col := range to.Columns {
+		fromCol := from.Column(col.Name)
+
+		if fromCol == nil {
+			changes = append(changes, SchemaChange{Action: "add", Kind: "column", Table: table, Name: col.Name, DDL: ddl.addColumn(table, col)})
+			continue
+		}
+
+		if !reflect.DeepEqual(*fromCol, col) {
+			changes = append(changes, SchemaChange{
+				Action: "modify",
+				Kind:   "column",
+				Table:  table,
+				Name:   col.Name,
+				From:   fromCol.Definition(genericDialect),
+				To:     col.Definition(genericDialect),
+				DDL:    ddl.modifyColumn(table, *fromCol, col),
+			})
+		}
+	}
+
+	for _, idx := range to.Indexes {
+		if fromIdx := from.Index(idx.Name); fromIdx == nil || !reflect.DeepEqual(*fromIdx, idx) {
+			changes = append(changes, SchemaChange{Action: "add", Kind: "index", Table: table, Name: idx.Name, DDL: ddl.createIndex(table, idx)})
+		}
+	}
+
+	return
+}
+
+// ddlGenerator generates nothing while driver is nil
+type ddlGenerator struct {
+	driver *sqlDriver
+}
+
+func (p *ddlGenerator) quote(name string) string {
+	return p.driver.Dialect.QuoteIdentifier(name)
+}
+
+func (p *ddlGenerator) createTable(table *TableSchema) string {
+	if p.driver == nil {
+		return ""
+	}
+	return table.CreateTableDDL(p.driver.Dialect)
+}
+
+func (p *ddlGenerator) dropTable(table TableSchema) string {
+	if p.driver == nil {
+		return ""
+	}
+	return "DROP TABLE " + p.quote(table.Name)
+}
+
+func (p *ddlGenerator) addColumn(table string, col ColumnDef) string {
+	if p.driver == nil {
+		return ""
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", p.quote(table), col.Definition(p.driver.Dialect))
+}
+
+func (p *ddlGenerator) dropColumn(table string, col ColumnDef) string {
+	if p.driver == nil {
+		return ""
+	}
+	return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", p.quote(table), p.quote(col.Name))
+}
+
+func (p *ddlGenerator) modifyColumn(table string, from, to ColumnDef) string {
+	if p.driver == nil {
+		return ""
+	}
+
+	switch p.driver.Name {
+	case "mysql":
+		return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", p.quote(table), to.Definition(p.driver.Dialect))
+	case "postgres":
+		prefix := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s", p.quote(table), p.quote(to.Name))
+
+		var items []string
+
+		if from.Type != to.Type {
+			items = append(items, fmt.Sprintf("%s TYPE %s", prefix, to.Type))
+		}
+
+		if from.Nullable != to.Nullable {
+			if to.Nullable {
+				items = append(items, prefix+" DROP NOT NULL")
+			} else {
+				items = append(items, prefix+" SET NOT NULL")
+			}
+		}
+
+		if !reflect.DeepEqual(from.Default, to.Default) {
+			if to.Default == nil {
+				items = append(items, prefix+" DROP DEFAULT")
+			} else {
+				items = append(items, prefix+" SET DEFAULT "+*to.Default)
+			}
+		}
+
+		return strings.Join(items, ";\n")
+	}
+
+	return fmt.Sprintf("-- %s could not alter column %s.%s, the table should be rebuilt", p.driver.Name, table, to.Name)
+}
+
+func (p *ddlGenerator) createIndex(table string, idx IndexDef) string {
+	if p.driver == nil {
+		return ""
+	}
+
+	if idx.Primary {
+		return fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (%s)", p.quote(table), quoteIdentifiers(p.driver.Dialect, idx.Columns))
+	}
+
+	unique := ""
+	if idx.Unique {
+		unique = "UNIQUE "
+	}
+
+	return fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", unique, p.quote(idx.Name), p.quote(table), quoteIdentifiers(p.driver.Dialect, idx.Columns))
+}
+
+func (p *ddlGenerator) dropIndex(table string, idx IndexDef) string {
+	if p.driver == nil {
+		return ""
+	}
+
+	switch {
+	case idx.Primary && p.driver.Name == "mysql":
+		return fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY", p.quote(table))
+	case idx.Primary && p.driver.Name == "postgres":
+		return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", p.quote(table), p.quote(idx.Name))
+	case idx.Primary:
+		return fmt.Sprintf("-- %s could not drop primary key of %s, the table should be rebuilt", p.driver.Name, table)
+	case p.driver.Name == "mysql":
+		return fmt.Sprintf("DROP INDEX %s ON %s", p.quote(idx.Name), p.quote(table))
+	}
+
+	return "DROP INDEX " + p.quote(idx.Name)
+}
+
+func (p *ddlGenerator) addForeignKey(table string, fk ForeignKeyDef) string {
+	if p.driver == nil {
+		return ""
+	}
+
+	if p.driver.Name == "sqlite3" {
+		return fmt.Sprintf("-- sqlite3 could not add foreign key %s to %s, the table should be rebuilt", fk.Name, table)
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+		p.quote(table), p.quote(fk.Name), quoteIdentifiers(p.driver.Dialect, fk.Columns),
+		p.quote(fk.RefTable), quoteIdentifiers(p.driver.Dialect, fk.RefColumns))
+}
+
+func (p *ddlGenerator) dropForeignKey(table string, fk ForeignKeyDef) string {
+	if p.driver == nil {
+		return ""
+	}
+
+	switch p.driver.Name {
+	case "mysql":
+		return fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", p.quote(table), p.quote(fk.Name))
+	case "sqlite3":
+		return fmt.Sprintf("-- sqlite3 could not drop foreign key %s of %s, the table should be rebuilt", fk.Name, table)
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", p.quote(table), p.quote(fk.Name))
+}
@@ -0,0 +1,179 @@
+package pwgen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSchemaOrder(t *testing.T) {
+
+	defaultName := "'guest'"
+
+	cases := []struct {
+		name     string
+		from     SchemaModel
+		to       SchemaModel
+		expected []string
+	}{
+		{
+			name: "foreign key of new table references a later table",
+			from: SchemaModel{},
+			to: SchemaModel{Tables: []TableSchema{
+				{
+					Name:        "order",
+					Columns:     []ColumnDef{{Name: "id", Type: "int"}, {Name: "user_id", Type: "int"}},
+					ForeignKeys: []ForeignKeyDef{{Name: "fk_order_user", Columns: []string{"user_id"}, RefTable: "user", RefColumns: []string{"id"}}},
+				},
+				{
+					Name:    "user",
+					Columns: []ColumnDef{{Name: "id", Type: "int"}},
+				},
+			}},
+			expected: []string{
+				"+ table order",
+				"+ table user",
+				"+ foreign key order.fk_order_user",
+			},
+		},
+		{
+			name: "referencing foreign key is dropped before table",
+			from: SchemaModel{Tables: []TableSchema{
+				{
+					Name:        "order",
+					Columns:     []ColumnDef{{Name: "id", Type: "int"}, {Name: "user_id", Type: "int"}},
+					ForeignKeys: []ForeignKeyDef{{Name: "fk_order_user", Columns: []string{"user_id"}, RefTable: "user", RefColumns: []string{"id"}}},
+				},
+				{
+					Name:    "user",
+					Columns: []ColumnDef{{Name: "id", Type: "int"}},
+				},
+			}},
+			to: SchemaModel{Tables: []TableSchema{
+				{
+					Name:    "order",
+					Columns: []ColumnDef{{Name: "id", Type: "int"}},
+				},
+			}},
+			expected: []string{
+				"- foreign key order.fk_order_user",
+				"- table user",
+				"- column order.user_id",
+			},
+		},
+		{
+			name: "foreign keys of dropped tables are dropped first",
+			from: SchemaModel{Tables: []TableSchema{
+				{
+					Name:        "a",
+					Columns:     []ColumnDef{{Name: "b_id", Type: "int"}},
+					ForeignKeys: []ForeignKeyDef{{Name: "fk_a_b", Columns: []string{"b_id"}, RefTable: "b", RefColumns: []string{"id"}}},
+				},
+				{
+					Name:    "b",
+					Columns: []ColumnDef{{Name: "id", Type: "int"}},
+				},
+			}},
+			to: SchemaModel{},
+			expected: []string{
+				"- foreign key a.fk_a_b",
+				"- table a",
+				"- table b",
+			},
+		},
+		{
+			name: "changed column and foreign key",
+			from: SchemaModel{Tables: []TableSchema{
+				{
+					Name:        "user",
+					Columns:     []ColumnDef{{Name: "id", Type: "int"}, {Name: "name", Type: "varchar(10)"}, {Name: "group_id", Type: "int"}},
+					ForeignKeys: []ForeignKeyDef{{Name: "fk_user_group", Columns: []string{"group_id"}, RefTable: "group", RefColumns: []string{"id"}}},
+				},
+			}},
+			to: SchemaModel{Tables: []TableSchema{
+				{
+					Name:        "user",
+					Columns:     []ColumnDef{{Name: "id", Type: "int"}, {Name: "name", Type: "varchar(20)", Default: &defaultName}, {Name: "group_id", Type: "int"}},
+					ForeignKeys: []ForeignKeyDef{{Name: "fk_user_group", Columns: []string{"group_id"}, RefTable: "team", RefColumns: []string{"id"}}},
+				},
+			}},
+			expected: []string{
+				"- foreign key user.fk_user_group",
+				"~ column user.name: \"name\" varchar(10) NOT NULL -> \"name\" varchar(20) NOT NULL DEFAULT 'guest'",
+				"+ foreign key user.fk_user_group",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		var lines []string
+		for _, change := range diffSchema(&c.from, &c.to, nil) {
+			lines = append(lines, change.String())
+		}
+
+		if !reflect.DeepEqual(lines, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, lines)
+		}
+	}
+}
+
+func TestDiffSchemaDDL(t *testing.T) {
+
+	from := SchemaModel{Tables: []TableSchema{
+		{Name: "b", Columns: []ColumnDef{{Name: "id", Type: "int"}}},
+	}}
+
+	to := SchemaModel{Tables: []TableSchema{
+		{
+			Name:        "a",
+			Columns:     []ColumnDef{{Name: "id", Type: "int", Extra: "AUTO_INCREMENT"}, {Name: "c_id", Type: "int", Nullable: true}},
+			Indexes:     []IndexDef{{Name: "PRIMARY", Columns: []string{"id"}, Unique: true, Primary: true}},
+			ForeignKeys: []ForeignKeyDef{{Name: "fk_a_c", Columns: []string{"c_id"}, RefTable: "c", RefColumns: []string{"id"}}},
+		},
+		{Name: "c", Columns: []ColumnDef{{Name: "id", Type: "int"}}},
+	}}
+
+	var ddls []string
+	for _, change := range diffSchema(&from, &to, &mysqlDriver) {
+		ddls = append(ddls, change.DDL)
+	}
+
+	expected := []string{
+		"DROP TABLE `b`",
+		"CREATE TABLE `a` (\n    `id` int NOT NULL AUTO_INCREMENT,\n    `c_id` int,\n    PRIMARY KEY (`id`)\n)",
+		"CREATE TABLE `c` (\n    `id` int NOT NULL\n)",
+		"ALTER TABLE `a` ADD CONSTRAINT `fk_a_c` FOREIGN KEY (`c_id`) REFERENCES `c` (`id`)",
+	}
+
+	if !reflect.DeepEqual(ddls, expected) {
+		t.Errorf("expected %q, got %q", expected, ddls)
+	}
+}
+
+func TestMySQLColumnDefinition(t *testing.T) {
+
+	cases := []struct {
+		def, extra      string
+		expectedDefault string
+		expectedExtra   string
+	}{
+		{def: "abc", extra: "", expectedDefault: "'abc'"},
+		{def: "it's", extra: "", expectedDefault: "'it''s'"},
+		{def: "0", extra: "", expectedDefault: "'0'"},
+		{def: "'abc'", extra: "", expectedDefault: "'abc'"},
+		{def: "b'1'", extra: "", expectedDefault: "b'1'"},
+		{def: "CURRENT_TIMESTAMP", extra: "DEFAULT_GENERATED on update CURRENT_TIMESTAMP", expectedDefault: "CURRENT_TIMESTAMP", expectedExtra: "ON UPDATE CURRENT_TIMESTAMP"},
+		{def: "current_timestamp()", extra: "on update current_timestamp()", expectedDefault: "current_timestamp()", expectedExtra: "ON UPDATE current_timestamp()"},
+		{def: "uuid()", extra: "DEFAULT_GENERATED", expectedDefault: "(uuid())"},
+		{def: "", extra: "auto_increment", expectedDefault: "''", expectedExtra: "AUTO_INCREMENT"},
+	}
+
+	for _, c := range cases {
+		if def := mysqlColumnDefault(c.def, c.extra); def != c.expectedDefault {
+			t.Errorf("default %q, %q: expected %s, got %s", c.def, c.extra, c.expectedDefault, def)
+		}
+
+		if extra := mysqlColumnExtra(c.extra); extra != c.expectedExtra {
+			t.Errorf("extra %q: expected %q, got %q", c.extra, c.expectedExtra, extra)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package pwgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
+)
+
+type snapshotFile struct {
+	Columns []string          `json:"columns"`
+	Key     []string          `json:"key,omitempty"`
+	Rows    []json.RawMessage `json:"rows"`
+}
+
+type SnapshotDiff struct {
+	Action   string          `json:"action"`
+	Key      json.RawMessage `json:"key"`
+	Column   string          `json:"column,omitempty"`
+	Expected json.RawMessage `json:"expected,omitempty"`
+	Actual   json.RawMessage `json:"actual,omitempty"`
+}
+
+func (p SnapshotDiff) String() string {
+	switch p.Action {
+	case "added":
+		return fmt.Sprintf("+ row %s: %s", p.Key, p.Actual)
+	case "removed":
+		return fmt.Sprintf("- row %s: %s", p.Key, p.Expected)
+	}
+
+	return fmt.Sprintf("~ row %s, %s: %s -> %s", p.Key, p.Column, p.Expected, p.Actual)
+}
+
+type SnapshotOutput struct {
+	File    string         `json:"file"`
+	Rows    int            `json:"rows"`
+	Written bool           `json:"written"`
+	Equal   bool           `json:"equal"`
+	Diffs   []SnapshotDiff `json:"diffs,omitempty"`
+}
+
+// snapshotRow keeps the canonical json of cells, so the values read from
+// database and file are comparable
+type snapshotRow struct {
+	cells map[string]string
+	keys  []string
+}
+
+func init() {
+	flow.RegisterHandler("toolkit.sql.snapshot", Snapshot)
+}
+
+// Snapshot compares the result of query with the golden file, the file is
+// written on the first run or update = true
+func Snapshot(ctx context.Context, conf config.Configuration) (err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	file := conf.GetString("file")
+	if len(file) == 0 {
+		err = fmt.Errorf("config of file could not be empty, e.g.: file = \"testdata/users.snapshot.json\"")
+		return
+	}
+
+	keys := conf.GetStringList("key")
+	ignore := conf.GetStringList("ignore-columns")
+	update := conf.GetBoolean("update", false)
+	maxDiffs := int(conf.GetInt32("max-diffs", 50))
+
+	sources, err := loadSQLSources(ctx, conf)
+	if err != nil {
+		return
+	}
+
+	if len(sources) != 1 {
+		err = fmt.Errorf("toolkit.sql.snapshot accepts exactly one of sql, sql-file, sql-files or sql-from-output, got %d sources", len(sources))
+		return
+	}
+
+	query, err := renderSQL(sources[0].SQL, conf.GetConfig("variables"), driver.Dialect)
+	if err != nil {
+		return
+	}
+
+	params := newSQLParams(conf)
+
+	query, args, err := params.Bind(query, driver)
+	if err != nil {
+		return
+	}
+
+	if err = params.Done(); err != nil {
+		return
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	result, err := queryAll(db, conf.GetString("column-case", "lower"), query, args...)
+	if err != nil {
+		return
+	}
+
+	current, err := newSnapshotFile(result, keys, ignore)
+	if err != nil {
+		return
+	}
+
+	output := SnapshotOutput{File: file, Rows: len(current.Rows), Equal: true}
+
+	_, errStat := os.Stat(file)
+
+	if update || os.IsNotExist(errStat) {
+		if err = current.Write(file); err != nil {
+			return
+		}
+
+		output.Written = true
+
+		logrus.WithField("FILE", file).WithField("ROWS", len(current.Rows)).Infoln("Snapshot written")
+	} else {
+		var golden *snapshotFile
+		golden, err = readSnapshotFile(file)
+		if err != nil {
+			return
+		}
+
+		output.Diffs, err = diffSnapshot(golden, current, keys)
+		if err != nil {
+			return
+		}
+
+		output.Equal = len(output.Diffs) == 0
+	}
+
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) > 0 {
+		var data []byte
+		data, err = json.Marshal(output)
+		if err != nil {
+			return
+		}
+
+		flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+	}
+
+	if !output.Equal {
+		var lines []string
+		for i, diff := range output.Diffs {
+			if maxDiffs > 0 && i >= maxDiffs {
+				lines = append(lines, fmt.Sprintf("... and %d more", len(output.Diffs)-maxDiffs))
+				break
+			}
+			lines = append(lines, diff.String())
+		}
+
+		err = fmt.Errorf("result mismatches snapshot %s, set update = true to accept:\n%s", file, strings.Join(lines, "\n"))
+		return
+	}
+
+	return
+}
+
+// newSnapshotFile removes the ignored columns and sorts the rows by key, the
+// whole row is the key if key is not configured
+func newSnapshotFile(result *queryResult, keys, ignore []string) (snapshot *snapshotFile, err error) {
+
+	ignored := map[string]bool{}
+	for _, column := range ignore {
+		ignored[column] = true
+	}
+
+	snapshot = &snapshotFile{Key: keys}
+
+	var indexes []int
+	for i, column := range result.Columns {
+		if !ignored[column] {
+			snapshot.Columns = append(snapshot.Columns, column)
+			indexes = append(indexes, i)
+		}
+	}
+
+	for _, key := range keys {
+		if !containsString(snapshot.Columns, key) {
+			err = fmt.Errorf("key column %s not found in result", key)
+			return
+		}
+	}
+
+	type sortableRow struct {
+		raw json.RawMessage
+		row *snapshotRow
+	}
+
+	rows := make([]sortableRow, 0, len(result.Rows))
+
+	for _, values := range result.Rows {
+		picked := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			picked[i] = values[index]
+		}
+
+		var raw json.RawMessage
+		raw, err = json.Marshal(resultRow{columns: snapshot.Columns, values: picked})
+		if err != nil {
+			return
+		}
+
+		var row *snapshotRow
+		row, err = parseSnapshotRow(raw, snapshot.Columns, keys)
+		if err != nil {
+			return
+		}
+
+		rows = append(rows, sortableRow{raw: raw, row: row})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return compareSnapshotKeys(rows[i].row.keys, rows[j].row.keys) < 0
+	})
+
+	for _, row := range rows {
+		snapshot.Rows = append(snapshot.Rows, row.raw)
+	}
+
+	return
+}
+
+func readSnapshotFile(file string) (snapshot *snapshotFile, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	snapshot = &snapshotFile{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		err = fmt.Errorf("parse snapshot %s failure: %s", file, err)
+		return
+	}
+
+	return
+}
+
+func (p *snapshotFile) Write(file string) error {
+	buf := bytes.NewBuffer(nil)
+
+	buf.WriteString("{\n")
+
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{{"columns", p.Columns}, {"key", p.Key}} {
+		data, err := json.Marshal(field.value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "    %q: %s,\n", field.name, data)
+	}
+
+	// one row per line, so the changes are readable in git diff
+	buf.WriteString("    \"rows\": [")
+
+	for i, row := range p.Rows {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("\n        ")
+		buf.Write(row)
+	}
+
+	if len(p.Rows) > 0 {
+		buf.WriteString("\n    ")
+	}
+
+	buf.WriteString("]\n}\n")
+
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+func parseSnapshotRow(raw json.RawMessage, columns, keys []string) (row *snapshotRow, err error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	values := map[string]interface{}{}
+	if err = decoder.Decode(&values); err != nil {
+		return
+	}
+
+	row = &snapshotRow{cells: map[string]string{}}
+
+	for _, column := range columns {
+		var cell []byte
+		cell, err = json.Marshal(values[column])
+		if err != nil {
+			return
+		}
+		row.cells[column] = string(cell)
+	}
+
+	if len(keys) == 0 {
+		keys = columns
+	}
+
+	for _, key := range keys {
+		row.keys = append(row.keys, row.cells[key])
+	}
+
+	return
+}
+
+func (p *snapshotRow) Key() string {
+	return strings.Join(p.keys, "\x00")
+}
+
+// KeyJSON returns the key columns as a json object
+func (p *snapshotRow) KeyJSON(columns, keys []string) json.RawMessage {
+	if len(keys) == 0 {
+		keys = columns
+	}
+
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = json.RawMessage(p.cells[key])
+	}
+
+	data, _ := json.Marshal(resultRow{columns: keys, values: values})
+
+	return data
+}
+
+// compareSnapshotKeys compares numbers by value, others by text
+func compareSnapshotKeys(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+
+		if x, errX := strconv.ParseFloat(a[i], 64); errX == nil {
+			if y, errY := strconv.ParseFloat(b[i], 64); errY == nil && x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		}
+
+		if a[i] < b[i] {
+			return -1
+		}
+		return 1
+	}
+
+	return len(a) - len(b)
+}
+
+func diffSnapshot(golden, current *snapshotFile, keys []string) (diffs []SnapshotDiff, err error) {
+
+	if strings.Join(golden.Columns, ",") != strings.Join(current.Columns, ",") {
+		expected, _ := json.Marshal(golden.Columns)
+		actual, _ := json.Marshal(current.Columns)
+		diffs = append(diffs, SnapshotDiff{Action: "changed", Key: json.RawMessage("{}"), Column: "(columns)", Expected: expected, Actual: actual})
+		return
+	}
+
+	goldenRows, goldenOrder, err := indexSnapshotRows(golden, keys)
+	if err != nil {
+		return
+	}
+
+	currentRows, currentOrder, err := indexSnapshotRows(current, keys)
+	if err != nil {
+		return
+	}
+
+	for i, key := range goldenOrder {
+		row := goldenRows[key]
+
+		actual, exist := currentRows[key]
+		if !exist {
+			diffs = append(diffs, SnapshotDiff{Action: "removed", Key: row.KeyJSON(golden.Columns, keys), Expected: golden.Rows[i]})
+			continue
+		}
+
+		for _, column := range golden.Columns {
+			if row.cells[column] != actual.cells[column] {
+				diffs = append(diffs, SnapshotDiff{
+					Action:   "changed",
+					Key:      row.KeyJSON(golden.Columns, keys),
+					Column:   column,
+					Expected: json.RawMessage(row.cells[column]),
+					Actual:   json.RawMessage(actual.cells[column]),
+				})
+			}
+		}
+	}
+
+	for i, key := range currentOrder {
+		if _, exist := goldenRows[key]; !exist {
+			diffs = append(diffs, SnapshotDiff{Action: "added", Key: currentRows[key].KeyJSON(current.Columns, keys), Actual: current.Rows[i]})
+		}
+	}
+
+	return
+}
+
+func indexSnapshotRows(snapshot *snapshotFile, keys []string) (rows map[string]*snapshotRow, order []string, err error) {
+
+	rows = map[string]*snapshotRow{}
+	occurrences := map[string]int{}
+
+	for _, raw := range snapshot.Rows {
+		var row *snapshotRow
+		row, err = parseSnapshotRow(raw, snapshot.Columns, keys)
+		if err != nil {
+			return
+		}
+
+		key := row.Key()
+
+		if _, exist := rows[key]; exist && len(keys) > 0 {
+			err = fmt.Errorf("duplicate key %s", row.KeyJSON(snapshot.Columns, keys))
+			return
+		}
+
+		// the same rows are distinguished by occurrence if key is not configured
+		if len(keys) == 0 {
+			occurrences[key]++
+			key += "\x01" + strconv.Itoa(occurrences[key])
+		}
+
+		rows[key] = row
+		order = append(order, key)
+	}
+
+	return
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
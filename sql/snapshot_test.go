@@ -0,0 +1,119 @@
+package pwgen
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNewSnapshotFile(t *testing.T) {
+
+	result := &queryResult{
+		Columns: []string{"id", "name", "updated_at"},
+		Rows: [][]interface{}{
+			{10, "c", "2018-06-01"},
+			{2, "b", "2018-06-02"},
+			{1, "a", "2018-06-03"},
+		},
+	}
+
+	snapshot, err := newSnapshotFile(result, []string{"id"}, []string{"updated_at"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"id", "name"}; !reflect.DeepEqual(snapshot.Columns, expected) {
+		t.Errorf("columns: expected %q, got %q", expected, snapshot.Columns)
+	}
+
+	// the keys are sorted by number, not by text
+	var rows []string
+	for _, row := range snapshot.Rows {
+		rows = append(rows, string(row))
+	}
+
+	if expected := []string{`{"id":1,"name":"a"}`, `{"id":2,"name":"b"}`, `{"id":10,"name":"c"}`}; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("rows: expected %q, got %q", expected, rows)
+	}
+
+	if _, err = newSnapshotFile(result, []string{"updated_at"}, []string{"updated_at"}); err == nil {
+		t.Errorf("ignored key: expected error, got nil")
+	}
+}
+
+func TestDiffSnapshot(t *testing.T) {
+
+	newSnapshot := func(key []string, rows ...string) *snapshotFile {
+		snapshot := &snapshotFile{Columns: []string{"id", "name"}, Key: key}
+		for _, row := range rows {
+			snapshot.Rows = append(snapshot.Rows, json.RawMessage(row))
+		}
+		return snapshot
+	}
+
+	cases := []struct {
+		name     string
+		golden   *snapshotFile
+		current  *snapshotFile
+		keys     []string
+		expected []string
+	}{
+		{
+			name:    "equal with different number format",
+			golden:  newSnapshot([]string{"id"}, `{"id":1,"name":"a"}`),
+			current: newSnapshot([]string{"id"}, `{"id": 1, "name": "a"}`),
+			keys:    []string{"id"},
+		},
+		{
+			name:    "added removed and changed",
+			golden:  newSnapshot([]string{"id"}, `{"id":1,"name":"a"}`, `{"id":2,"name":"b"}`),
+			current: newSnapshot([]string{"id"}, `{"id":2,"name":"x"}`, `{"id":3,"name":"c"}`),
+			keys:    []string{"id"},
+			expected: []string{
+				`- row {"id":1}: {"id":1,"name":"a"}`,
+				`~ row {"id":2}, name: "b" -> "x"`,
+				`+ row {"id":3}: {"id":3,"name":"c"}`,
+			},
+		},
+		{
+			name:    "duplicated rows without key",
+			golden:  newSnapshot(nil, `{"id":1,"name":"a"}`, `{"id":1,"name":"a"}`),
+			current: newSnapshot(nil, `{"id":1,"name":"a"}`),
+			expected: []string{
+				`- row {"id":1,"name":"a"}: {"id":1,"name":"a"}`,
+			},
+		},
+		{
+			name:    "columns changed",
+			golden:  newSnapshot([]string{"id"}),
+			current: &snapshotFile{Columns: []string{"id", "email"}},
+			keys:    []string{"id"},
+			expected: []string{
+				`~ row {}, (columns): ["id","name"] -> ["id","email"]`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		diffs, err := diffSnapshot(c.golden, c.current, c.keys)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+
+		var lines []string
+		for _, diff := range diffs {
+			lines = append(lines, diff.String())
+		}
+
+		if !reflect.DeepEqual(lines, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, lines)
+		}
+	}
+
+	// the key should be unique
+	golden := newSnapshot([]string{"id"}, `{"id":1,"name":"a"}`, `{"id":1,"name":"b"}`)
+	if _, err := diffSnapshot(golden, newSnapshot([]string{"id"}), []string{"id"}); err == nil {
+		t.Errorf("duplicate key: expected error, got nil")
+	}
+}
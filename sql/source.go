@@ -0,0 +1,87 @@
+package pwgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+)
+
+// sqlSource is the sql text from inline config, file or output of previous step
+type sqlSource struct {
+	Name string
+	SQL  string
+}
+
+// loadSQLSources collects the sources in order of sql, sql-file, sql-files and sql-from-output
+func loadSQLSources(ctx context.Context, conf config.Configuration) (sources []sqlSource, err error) {
+
+	if text := conf.GetString("sql"); len(strings.TrimSpace(text)) > 0 {
+		sources = append(sources, sqlSource{Name: "inline", SQL: text})
+	}
+
+	var files []string
+
+	if file := conf.GetString("sql-file"); len(file) > 0 {
+		files = append(files, file)
+	}
+
+	if pattern := conf.GetString("sql-files"); len(pattern) > 0 {
+		var matches []string
+		matches, err = filepath.Glob(pattern)
+		if err != nil {
+			return
+		}
+
+		if len(matches) == 0 {
+			err = fmt.Errorf("no sql file matches %s", pattern)
+			return
+		}
+
+		sort.Strings(matches)
+
+		files = append(files, matches...)
+	}
+
+	for _, file := range files {
+		var data []byte
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return
+		}
+
+		sources = append(sources, sqlSource{Name: file, SQL: string(data)})
+	}
+
+	if outputName := conf.GetString("sql-from-output"); len(outputName) > 0 {
+		outputs := flow.FindOutput(ctx, outputName, conf.GetStringList("sql-from-output-tags")...)
+
+		if len(outputs) == 0 {
+			err = fmt.Errorf("output of %s not found", outputName)
+			return
+		} else if len(outputs) > 1 {
+			err = fmt.Errorf("conflict of output name: %s, set sql-from-output-tags to filter", outputName)
+			return
+		}
+
+		sources = append(sources, sqlSource{Name: "output:" + outputName, SQL: outputText(outputs[0].Value)})
+	}
+
+	return
+}
+
+// outputText unquotes the output if it is a json string, e.g.: the text
+// formats of toolkit.sql.query
+func outputText(value []byte) string {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return text
+	}
+	return string(value)
+}
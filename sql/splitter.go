@@ -0,0 +1,320 @@
+package pwgen
+
+import (
+	"fmt"
+	"strings"
+)
+
+type sqlDialect struct {
+	// backslash escapes inside quoted strings, e.g.: 'it\'s'
+	BackslashEscape bool
+	// `quoted identifier`
+	Backtick bool
+	// # comment
+	HashComment bool
+	// DELIMITER $$ client command
+	DelimiterCommand bool
+	// $$ body $$ or $tag$ body $tag$
+	DollarQuote bool
+}
+
+var (
+	mysqlDialect      = sqlDialect{BackslashEscape: true, Backtick: true, HashComment: true, DelimiterCommand: true}
+	postgresDialect   = sqlDialect{DollarQuote: true}
+	clickhouseDialect = sqlDialect{BackslashEscape: true, Backtick: true}
+	genericDialect    = sqlDialect{}
+)
+
+// compoundObjects are the objects which body could be a BEGIN ... END block
+var compoundObjects = map[string]bool{
+	"PROCEDURE": true,
+	"FUNCTION":  true,
+	"TRIGGER":   true,
+	"EVENT":     true,
+}
+
+// endSuffixes are the keywords of END IF, END CASE ..., the suffix is skipped,
+// so it is not read as the opening of another block, only CASE was counted
+// as a block when it was opened
+var endSuffixes = map[string]bool{
+	"IF":     false,
+	"LOOP":   false,
+	"WHILE":  false,
+	"REPEAT": false,
+	"CASE":   true,
+}
+
+type sqlSplitter struct {
+	script  string
+	dialect sqlDialect
+
+	pos        int
+	delimiter  string
+	statements []string
+
+	stmt      strings.Builder
+	hasCode   bool
+	firstWord string
+	words     int
+	compound  bool
+	depth     int
+	skipWord  bool
+}
+
+// splitSQL splits script into statements, the delimiters inside of quotes,
+// comments, dollar quoted bodies and BEGIN ... END blocks of stored programs
+// are ignored, the returned statements have no trailing delimiter
+func splitSQL(script string, dialect sqlDialect) ([]string, error) {
+	s := &sqlSplitter{
+		script:    script,
+		dialect:   dialect,
+		delimiter: ";",
+	}
+
+	if err := s.split(); err != nil {
+		return nil, err
+	}
+
+	return s.statements, nil
+}
+
+func (p *sqlSplitter) split() (err error) {
+
+	atLineStart := true
+
+	for p.pos < len(p.script) {
+
+		if atLineStart && p.dialect.DelimiterCommand && !p.hasCode {
+			var ok bool
+			ok, err = p.delimiterCommand()
+			if err != nil {
+				return
+			}
+			if ok {
+				continue
+			}
+		}
+
+		c := p.script[p.pos]
+		rest := p.script[p.pos:]
+
+		atLineStart = c == '\n' || (atLineStart && (c == ' ' || c == '\t'))
+
+		switch {
+		case (p.depth == 0 || p.delimiter != ";") && strings.HasPrefix(rest, p.delimiter):
+			p.flush()
+			p.pos += len(p.delimiter)
+		case strings.HasPrefix(rest, "--") || (p.dialect.HashComment && c == '#'):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			p.write(rest[:end], false)
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return p.errorf("unterminated comment")
+			}
+			// /*! ... */ is the executable comment of mysql
+			p.write(rest[:end+4], strings.HasPrefix(rest, "/*!"))
+		case c == '\'' || c == '"' || (p.dialect.Backtick && c == '`'):
+			var end int
+			end, err = p.scanQuoted(c)
+			if err != nil {
+				return
+			}
+			p.write(rest[:end], true)
+		case p.dialect.DollarQuote && c == '$':
+			tag := p.dollarTag()
+			if len(tag) == 0 {
+				p.write("$", true)
+				continue
+			}
+			end := strings.Index(rest[len(tag):], tag)
+			if end < 0 {
+				return p.errorf("unterminated dollar quoted string %s", tag)
+			}
+			p.write(rest[:end+len(tag)*2], true)
+		case isWordChar(c):
+			end := 1
+			for end < len(rest) && isWordChar(rest[end]) {
+				end++
+			}
+			p.keyword(rest[:end])
+			p.write(rest[:end], true)
+		default:
+			p.write(string(c), !isSpace(c))
+		}
+	}
+
+	p.flush()
+
+	return
+}
+
+// delimiterCommand handles the client command 'DELIMITER xx' of mysql
+func (p *sqlSplitter) delimiterCommand() (bool, error) {
+	rest := p.script[p.pos:]
+	line := rest
+	if end := strings.IndexByte(rest, '\n'); end >= 0 {
+		line = rest[:end]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "DELIMITER") {
+		return false, nil
+	}
+
+	if len(fields) != 2 {
+		return false, p.errorf("bad delimiter command: %s", strings.TrimSpace(line))
+	}
+
+	p.delimiter = fields[1]
+	p.pos += len(line)
+
+	return true, nil
+}
+
+func (p *sqlSplitter) scanQuoted(quote byte) (int, error) {
+	rest := p.script[p.pos:]
+
+	backslash := p.dialect.BackslashEscape && quote != '`'
+
+	// E'...' of postgres
+	if quote == '\'' && p.pos > 0 && (p.script[p.pos-1] == 'E' || p.script[p.pos-1] == 'e') &&
+		(p.pos < 2 || !isWordChar(p.script[p.pos-2])) {
+		backslash = true
+	}
+
+	for i := 1; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(rest) && rest[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1, nil
+		}
+	}
+
+	return 0, p.errorf("unterminated quoted string")
+}
+
+// dollarTag returns $$ or $tag$ at current position, or empty if it is not a dollar quote
+func (p *sqlSplitter) dollarTag() string {
+	if p.pos > 0 && isWordChar(p.script[p.pos-1]) {
+		return ""
+	}
+
+	rest := p.script[p.pos:]
+
+	for i := 1; i < len(rest); i++ {
+		c := rest[i]
+		if c == '$' {
+			return rest[:i+1]
+		}
+
+		if !isWordChar(c) || (i == 1 && c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+
+	return ""
+}
+
+func (p *sqlSplitter) keyword(word string) {
+	upper := strings.ToUpper(word)
+
+	p.words++
+
+	if p.skipWord {
+		p.skipWord = false
+		return
+	}
+
+	if len(p.firstWord) == 0 {
+		p.firstWord = upper
+		return
+	}
+
+	// CREATE [OR REPLACE] [DEFINER = ...] PROCEDURE
+	if p.firstWord == "CREATE" && !p.compound && p.words <= 8 && compoundObjects[upper] {
+		p.compound = true
+		return
+	}
+
+	if !p.compound {
+		return
+	}
+
+	switch upper {
+	case "BEGIN", "CASE":
+		p.depth++
+	case "END":
+		// END closes BEGIN and CASE expression, END CASE closes CASE statement
+		counted, suffix := endSuffixes[strings.ToUpper(p.nextWord(len(word)))]
+		if suffix {
+			p.skipWord = true
+			if !counted {
+				return
+			}
+		}
+		if p.depth > 0 {
+			p.depth--
+		}
+	}
+}
+
+func (p *sqlSplitter) nextWord(offset int) string {
+	rest := p.script[p.pos+offset:]
+	start := 0
+	for start < len(rest) && isSpace(rest[start]) {
+		start++
+	}
+
+	end := start
+	for end < len(rest) && isWordChar(rest[end]) {
+		end++
+	}
+
+	return rest[start:end]
+}
+
+func (p *sqlSplitter) write(s string, code bool) {
+	p.stmt.WriteString(s)
+	p.pos += len(s)
+	if code {
+		p.hasCode = true
+	}
+}
+
+func (p *sqlSplitter) flush() {
+	if p.hasCode {
+		p.statements = append(p.statements, strings.TrimSpace(p.stmt.String()))
+	}
+
+	p.stmt.Reset()
+	p.hasCode = false
+	p.firstWord = ""
+	p.words = 0
+	p.compound = false
+	p.depth = 0
+	p.skipWord = false
+}
+
+func (p *sqlSplitter) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.script[:p.pos], "\n") + 1
+	return fmt.Errorf("parse sql failure at line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
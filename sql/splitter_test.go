@@ -0,0 +1,109 @@
+package pwgen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSQL(t *testing.T) {
+
+	cases := []struct {
+		name     string
+		dialect  sqlDialect
+		script   string
+		expected []string
+	}{
+		{
+			name:     "simple",
+			dialect:  mysqlDialect,
+			script:   "SELECT 1; SELECT 'a;b'; -- c;\nSELECT 2",
+			expected: []string{"SELECT 1", "SELECT 'a;b'", "-- c;\nSELECT 2"},
+		},
+		{
+			name:    "nested begin end",
+			dialect: mysqlDialect,
+			script: `CREATE PROCEDURE p()
+BEGIN
+  BEGIN
+    SELECT 1;
+  END;
+  SELECT 2;
+END;
+INSERT INTO t VALUES (1);`,
+			expected: []string{
+				"CREATE PROCEDURE p()\nBEGIN\n  BEGIN\n    SELECT 1;\n  END;\n  SELECT 2;\nEND",
+				"INSERT INTO t VALUES (1)",
+			},
+		},
+		{
+			name:    "end case",
+			dialect: mysqlDialect,
+			script: `CREATE PROCEDURE p(x INT)
+BEGIN
+  CASE x
+    WHEN 1 THEN SELECT 1;
+    ELSE SELECT 2;
+  END CASE;
+  SELECT CASE WHEN x > 0 THEN 1 ELSE 0 END;
+END;
+INSERT INTO t VALUES (1);
+INSERT INTO t VALUES (2);`,
+			expected: []string{
+				"CREATE PROCEDURE p(x INT)\nBEGIN\n  CASE x\n    WHEN 1 THEN SELECT 1;\n    ELSE SELECT 2;\n  END CASE;\n  SELECT CASE WHEN x > 0 THEN 1 ELSE 0 END;\nEND",
+				"INSERT INTO t VALUES (1)",
+				"INSERT INTO t VALUES (2)",
+			},
+		},
+		{
+			name:    "end if and loop",
+			dialect: mysqlDialect,
+			script: `CREATE FUNCTION f(x INT) RETURNS INT
+BEGIN
+  IF x > 0 THEN
+    l: LOOP
+      LEAVE l;
+    END LOOP l;
+  END IF;
+  RETURN x;
+END;
+SELECT f(1);`,
+			expected: []string{
+				"CREATE FUNCTION f(x INT) RETURNS INT\nBEGIN\n  IF x > 0 THEN\n    l: LOOP\n      LEAVE l;\n    END LOOP l;\n  END IF;\n  RETURN x;\nEND",
+				"SELECT f(1)",
+			},
+		},
+		{
+			name:    "custom delimiter",
+			dialect: mysqlDialect,
+			script: `DELIMITER $$
+CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW
+BEGIN
+  SET NEW.a = 1;
+END$$
+DELIMITER ;
+INSERT INTO t VALUES (1);`,
+			expected: []string{
+				"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW\nBEGIN\n  SET NEW.a = 1;\nEND",
+				"INSERT INTO t VALUES (1)",
+			},
+		},
+		{
+			name:     "dollar quote",
+			dialect:  postgresDialect,
+			script:   "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT 2;",
+			expected: []string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT 2"},
+		},
+	}
+
+	for _, c := range cases {
+		statements, err := splitSQL(c.script, c.dialect)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(statements, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, statements)
+		}
+	}
+}
@@ -2,46 +2,22 @@ package pwgen
 
 import (
 	"bytes"
-	"database/sql"
+	goctx "context"
+	"encoding/json"
 	"fmt"
-	"strings"
+	"io/ioutil"
 	"text/template"
 
-	"github.com/elgs/gosqljson"
 	"github.com/gogap/config"
 	"github.com/gogap/context"
 	"github.com/gogap/flow"
+	"github.com/sirupsen/logrus"
 )
 
 var (
 	Tags = []string{"toolkit", "sql"}
 )
 
-type sqlConfig struct {
-	Driver   string
-	User     string
-	Password string
-	Host     string
-	Port     int
-	Db       string
-	Charset  string
-	Location string
-}
-
-func (p *sqlConfig) DSN() string {
-	if p.Driver == "mysql" {
-		loc := strings.Replace(p.Location, "/", "%2F", 1)
-		return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s&loc=%s", p.User, p.Password, p.Host, p.Port, p.Db, p.Charset, loc)
-	} else if p.Driver == "postgres" {
-		if len(p.Db) == 0 {
-			p.Db = "postgres"
-		}
-		return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", p.Host, p.Port, p.User, p.Password, p.Db)
-	}
-
-	panic("unsupport driver:" + p.Driver)
-}
-
 func init() {
 	flow.RegisterHandler("toolkit.sql.query", Query)
 	flow.RegisterHandler("toolkit.sql.exec", Exec)
@@ -53,42 +29,124 @@ func Query(ctx context.Context, conf config.Configuration) (err error) {
 		return
 	}
 
-	sqlConf := sqlConfig{
-		Driver:   conf.GetString("driver", "mysql"),
-		Host:     conf.GetString("host", "localhost"),
-		Port:     int(conf.GetInt32("port", 3306)),
-		Db:       conf.GetString("db"),
-		User:     conf.GetString("user", "root"),
-		Password: conf.GetString("password"),
-		Charset:  conf.GetString("charset", "utf8"),
-		Location: conf.GetString("loc"),
+	sqlConf := newSQLConfig(conf)
+
+	driver, err := sqlConf.driver()
+	if err != nil {
+		return
+	}
+
+	sources, err := loadSQLSources(ctx, conf)
+	if err != nil {
+		return
 	}
 
-	sqlQuery := conf.GetString("sql")
+	if len(sources) != 1 {
+		err = fmt.Errorf("toolkit.sql.query accepts exactly one of sql, sql-file, sql-files or sql-from-output, got %d sources", len(sources))
+		return
+	}
 
-	sqlQuery, err = renderSQL(sqlQuery, conf.GetConfig("variables"))
+	sqlQuery, err := renderSQL(sources[0].SQL, conf.GetConfig("variables"), driver.Dialect)
 	if err != nil {
 		return
 	}
 
-	db, err := sql.Open(sqlConf.Driver, sqlConf.DSN())
+	params := newSQLParams(conf)
 
+	sqlQuery, args, err := params.Bind(sqlQuery, driver)
 	if err != nil {
 		return
 	}
 
-	jsonQuery, err := gosqljson.QueryDbToMapJSON(db, "lower", sqlQuery)
+	if err = params.Done(); err != nil {
+		return
+	}
 
+	db, err := sqlConf.Connect(ctx)
 	if err != nil {
 		return
 	}
 
 	outputName := conf.GetString("output.name")
 
-	if len(outputName) > 0 {
-		flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: []byte(jsonQuery), Tags: Tags})
+	if exportOpts := newExportOptions(conf); len(exportOpts.File) > 0 {
+		var exported *ExportOutput
+		exported, err = exportQuery(db, driver, exportOpts, sqlQuery, args...)
+		if err != nil {
+			return
+		}
+
+		if len(outputName) == 0 {
+			return
+		}
+
+		var data []byte
+		data, err = json.Marshal(exported)
+		if err != nil {
+			return
+		}
+
+		flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+
+		return
+	}
+
+	result, err := queryAll(db, conf.GetString("column-case", "lower"), sqlQuery, args...)
+
+	if err != nil {
+		return
 	}
 
+	format := conf.GetString("format", "json")
+	scalar := conf.GetBoolean("scalar", false)
+	singleRow := conf.GetBoolean("single-row", false)
+
+	var data []byte
+
+	switch {
+	case scalar:
+		var value interface{}
+		if value, err = result.Scalar(); err != nil {
+			return
+		}
+		data, err = json.Marshal(value)
+	case singleRow:
+		var row interface{}
+		if row, err = result.SingleRow(); err != nil {
+			return
+		}
+		data, err = json.Marshal(row)
+	default:
+		data, err = result.Render(format)
+	}
+
+	if err != nil {
+		return
+	}
+
+	outputFile := conf.GetString("output.file")
+
+	if len(outputFile) > 0 {
+		err = ioutil.WriteFile(outputFile, data, 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	// the output value should be json, the text formats are kept as string
+	if format != "json" && !scalar && !singleRow {
+		data, err = json.Marshal(string(data))
+		if err != nil {
+			return
+		}
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+
 	return
 }
 
@@ -98,77 +156,143 @@ func Exec(ctx context.Context, conf config.Configuration) (err error) {
 		return
 	}
 
-	sqlConf := sqlConfig{
-		Driver:   conf.GetString("driver", "mysql"),
-		Host:     conf.GetString("host", "localhost"),
-		Port:     int(conf.GetInt32("port", 3306)),
-		Db:       conf.GetString("db"),
-		User:     conf.GetString("user", "root"),
-		Password: conf.GetString("password"),
-		Charset:  conf.GetString("charset", "utf8"),
-		Location: conf.GetString("loc"),
-	}
-
-	sqlExec := conf.GetString("sql")
+	sqlConf := newSQLConfig(conf)
 
-	sqlExec, err = renderSQL(sqlExec, conf.GetConfig("variables"))
+	driver, err := sqlConf.driver()
 	if err != nil {
 		return
 	}
 
-	db, err := sql.Open(sqlConf.Driver, sqlConf.DSN())
-
+	sources, err := loadSQLSources(ctx, conf)
 	if err != nil {
 		return
 	}
 
-	defer db.Close()
+	if len(sources) == 0 {
+		err = fmt.Errorf("config of sql, sql-file, sql-files or sql-from-output could not be empty")
+		return
+	}
+
+	onError := conf.GetString("on-error", "stop")
+
+	if onError != "stop" && onError != "continue" {
+		err = fmt.Errorf("unknown on-error: %s, should be one of stop, continue", onError)
+		return
+	}
 
 	isTrans := conf.GetBoolean("tx", true)
 
-	sqls := strings.Split(sqlExec, ";")
+	params := newSQLParams(conf)
 
-	if isTrans {
+	sqls := make([][]string, len(sources))
+	args := make([][][]interface{}, len(sources))
 
-		var tx *sql.Tx
-		tx, err = db.Begin()
+	for i, source := range sources {
+		var text string
+		text, err = renderSQL(source.SQL, conf.GetConfig("variables"), driver.Dialect)
 		if err != nil {
+			err = fmt.Errorf("%s: %s", source.Name, err)
 			return
 		}
 
-		for i := 0; i < len(sqls); i++ {
-			sql := trimSQL(sqls[i])
-			if len(sql) == 0 {
-				continue
-			}
-			_, err = gosqljson.ExecTx(tx, sql)
+		sqls[i], err = splitSQL(text, driver.Dialect)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", source.Name, err)
+			return
+		}
+
+		args[i] = make([][]interface{}, len(sqls[i]))
+
+		for j := 0; j < len(sqls[i]); j++ {
+			sqls[i][j], args[i][j], err = params.Bind(sqls[i][j], driver)
 			if err != nil {
-				tx.Rollback()
+				err = fmt.Errorf("%s: %s", source.Name, err)
 				return
 			}
 		}
+	}
 
-		err = tx.Commit()
-		if err != nil {
-			return
-		}
-	} else {
-		for i := 0; i < len(sqls); i++ {
-			sql := trimSQL(sqls[i])
-			if len(sql) == 0 {
-				continue
-			}
-			_, err = gosqljson.ExecDb(db, sql)
-			if err != nil {
+	if err = params.Done(); err != nil {
+		return
+	}
+
+	expects := newRowsAffectedExpects(conf.GetConfig("expect-rows-affected"))
+
+	if len(expects) > 0 && !isTrans {
+		err = fmt.Errorf("expect-rows-affected requires tx = true")
+		return
+	}
+
+	if len(expects) > 0 && len(sources) > 1 {
+		err = fmt.Errorf("expect-rows-affected requires a single sql source")
+		return
+	}
+
+	txOpts, err := newTxOptions(conf)
+	if err != nil {
+		return
+	}
+
+	db, err := sqlConf.Connect(ctx)
+	if err != nil {
+		return
+	}
+
+	c := goctx.Background()
+
+	output := &ExecOutput{}
+
+	// each source is executed in its own transaction
+	for i, source := range sources {
+
+		result, errExec := execScript(c, db, driver, isTrans, txOpts, sqls[i], args[i], expects)
+
+		sourceResult := SourceResult{Name: source.Name, Statements: len(sqls[i])}
+
+		if errExec != nil {
+			if onError == "stop" {
+				err = fmt.Errorf("%s: %s", source.Name, errExec)
 				return
 			}
+
+			sourceResult.Error = errExec.Error()
+			output.Sources = append(output.Sources, sourceResult)
+
+			logrus.WithField("SOURCE", source.Name).WithField("ERROR", errExec.Error()).Warnln("Execute sql failure, continue")
+
+			continue
+		}
+
+		for _, stmt := range result.Statements {
+			stmt.Source = source.Name
+			output.Statements = append(output.Statements, stmt)
 		}
+
+		sourceResult.RowsAffected = result.RowsAffected
+
+		output.RowsAffected += result.RowsAffected
+		output.Sources = append(output.Sources, sourceResult)
 	}
 
+	outputName := conf.GetString("output.name")
+
+	if len(outputName) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return
+	}
+
+	flow.AppendOutput(ctx, flow.NameValue{Name: outputName, Value: data, Tags: Tags})
+
 	return
 }
 
-func renderSQL(sqlExec string, varsConf config.Configuration) (string, error) {
+// renderSQL renders the variables into sql by text/template, it should only
+// be used for identifiers, values should be passed by params
+func renderSQL(sqlExec string, varsConf config.Configuration, dialect sqlDialect) (string, error) {
 
 	vars := make(map[string]string)
 
@@ -178,7 +302,9 @@ func renderSQL(sqlExec string, varsConf config.Configuration) (string, error) {
 		}
 	}
 
-	tmp, err := template.New("sql").Parse(sqlExec)
+	lintTemplate(sqlExec, dialect)
+
+	tmp, err := template.New("sql").Funcs(templateFuncs(dialect)).Parse(sqlExec)
 	if err != nil {
 		return "", err
 	}
@@ -192,18 +318,3 @@ func renderSQL(sqlExec string, varsConf config.Configuration) (string, error) {
 
 	return buf.String(), nil
 }
-
-func trimSQL(sql string) string {
-	sql = strings.TrimSuffix(sql, "\n")
-	sql = strings.TrimSuffix(sql, ";")
-
-	sql = strings.TrimSpace(sql)
-
-	if len(sql) == 0 {
-		return ""
-	}
-
-	sql = sql + ";"
-
-	return sql
-}
@@ -0,0 +1,327 @@
+package ssh
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flow-contrib/toolkit/utils/shell"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/sftp"
+)
+
+type archiveOptions struct {
+	Format          string
+	Transport       string
+	StripComponents int
+	Release         bool
+	ReleaseName     string
+	CurrentLink     string
+}
+
+type countWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (p *countWriter) Write(b []byte) (n int, err error) {
+	n, err = p.w.Write(b)
+	atomic.AddInt64(&p.written, int64(n))
+	return
+}
+
+func (p *countWriter) Written() int64 {
+	return atomic.LoadInt64(&p.written)
+}
+
+func (p *archiveOptions) validate() error {
+	switch p.Format {
+	case "tar.gz", "tar.zst":
+	default:
+		return fmt.Errorf("unsupported archive format: %s, should be 'tar.gz' or 'tar.zst'", p.Format)
+	}
+
+	switch p.Transport {
+	case "stream", "sftp":
+	default:
+		return fmt.Errorf("unsupported archive transport: %s, should be 'stream' or 'sftp'", p.Transport)
+	}
+
+	if p.StripComponents < 0 {
+		return fmt.Errorf("strip-components could not be negative")
+	}
+
+	if p.Release && len(p.CurrentLink) == 0 {
+		return fmt.Errorf("current-link could not be empty in release mode")
+	}
+
+	if link := path.Clean(p.CurrentLink); p.Release && (path.IsAbs(link) || link == ".." || strings.HasPrefix(link, "../")) {
+		return fmt.Errorf("current-link %s should be relative to the remote directory", p.CurrentLink)
+	}
+
+	return nil
+}
+
+// extractCommand builds the remote shell command which extracts the archive
+// read from archiveFile into dir, archiveFile "-" means stdin
+func (p *archiveOptions) extractCommand(dir, archiveFile string) string {
+	tarArgs := fmt.Sprintf("-C %s", shell.Escape(dir))
+	if p.StripComponents > 0 {
+		tarArgs += fmt.Sprintf(" --strip-components=%d", p.StripComponents)
+	}
+
+	mkdir := fmt.Sprintf("mkdir -p %s", shell.Escape(dir))
+
+	if p.Format == "tar.zst" {
+		return fmt.Sprintf("%s && zstd -dc %s | tar -xf - %s", mkdir, shell.Escape(archiveFile), tarArgs)
+	}
+
+	return fmt.Sprintf("%s && tar -xzf %s %s", mkdir, shell.Escape(archiveFile), tarArgs)
+}
+
+// flipCommand points the current link of remoteRoot to the release directory,
+// the new link is created beside the old one and renamed over it, so the
+// switch is atomic. The target is relative to the directory of link, and the
+// rename requires mv -T of GNU or mv -h of BSD
+func (p *archiveOptions) flipCommand(remoteRoot string) string {
+	link := path.Clean(p.CurrentLink)
+	tmpLink := path.Join(path.Dir(link), "."+path.Base(link)+".tmp")
+
+	target := path.Join("releases", p.ReleaseName)
+	if dir := path.Dir(link); dir != "." {
+		target = path.Join(strings.Repeat("../", strings.Count(dir, "/")+1), target)
+	}
+
+	return fmt.Sprintf("cd %s && ln -sfn %s %s && { mv -fT %s %s 2>/dev/null || mv -fh %s %s; }",
+		shell.Escape(remoteRoot),
+		shell.Escape(target),
+		shell.Escape(tmpLink),
+		shell.Escape(tmpLink),
+		shell.Escape(link),
+		shell.Escape(tmpLink),
+		shell.Escape(link),
+	)
+}
+
+func uploadArchive(cli *Client, sftpClient *sftp.Client, quiet bool, opts archiveOptions, ignore []string, localPath, remoteRoot string) (err error) {
+
+	if err = opts.validate(); err != nil {
+		return
+	}
+
+	if _, err = os.Stat(localPath); err != nil {
+		return
+	}
+
+	errWriter := bytes.NewBuffer(nil)
+	cli.Stderr = errWriter
+	defer func() { cli.Stderr = nil }()
+
+	targetDir := remoteRoot
+	if opts.Release {
+		targetDir = path.Join(remoteRoot, "releases", opts.ReleaseName)
+	}
+
+	counter := &countWriter{}
+
+	if !quiet {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					fmt.Printf("%d bytes (%s -> %s)\n\r", counter.Written(), localPath, targetDir)
+					return
+				case <-ticker.C:
+					fmt.Printf("%d bytes (%s -> %s)\r", counter.Written(), localPath, targetDir)
+				}
+			}
+		}()
+	}
+
+	if opts.Transport == "sftp" {
+		err = uploadArchiveBySFTP(cli, sftpClient, counter, opts, ignore, localPath, targetDir)
+	} else {
+		err = uploadArchiveByStream(cli, counter, opts, ignore, localPath, targetDir)
+	}
+
+	if err != nil {
+		if errWriter.Len() > 0 {
+			err = fmt.Errorf("upload archive %s to %s failure: %s, details: %s", localPath, targetDir, err, strings.TrimSuffix(errWriter.String(), "\n"))
+		}
+		return
+	}
+
+	return
+}
+
+// flipRelease switches the current link of remoteRoot, it runs once after all
+// archives of the step are extracted into the release directory
+func flipRelease(cli *Client, opts archiveOptions, remoteRoot string) (err error) {
+
+	errWriter := bytes.NewBuffer(nil)
+	cli.Stderr = errWriter
+	defer func() { cli.Stderr = nil }()
+
+	err = cli.Exec(opts.flipCommand(remoteRoot))
+	if err != nil {
+		if errWriter.Len() > 0 {
+			err = fmt.Errorf("%s, details: %s", err, strings.TrimSuffix(errWriter.String(), "\n"))
+		}
+		err = fmt.Errorf("switch %s to release %s failure: %s", path.Join(remoteRoot, opts.CurrentLink), opts.ReleaseName, err)
+		return
+	}
+
+	return
+}
+
+func uploadArchiveByStream(cli *Client, counter *countWriter, opts archiveOptions, ignore []string, localPath, targetDir string) (err error) {
+
+	pr, pw := io.Pipe()
+
+	counter.w = pw
+
+	writeCh := make(chan error, 1)
+	go func() {
+		e := writeArchive(counter, opts.Format, ignore, localPath)
+		pw.CloseWithError(e)
+		writeCh <- e
+	}()
+
+	err = cli.Pipe(opts.extractCommand(targetDir, "-"), pr)
+	pr.Close()
+
+	if errWrite := <-writeCh; errWrite != nil && errWrite != io.ErrClosedPipe {
+		return errWrite
+	}
+
+	return
+}
+
+func uploadArchiveBySFTP(cli *Client, sftpClient *sftp.Client, counter *countWriter, opts archiveOptions, ignore []string, localPath, targetDir string) (err error) {
+
+	remoteArchive := path.Join("/tmp", fmt.Sprintf("toolkit-upload-%d.%s", time.Now().UnixNano(), opts.Format))
+
+	var remoteFile *sftp.File
+	remoteFile, err = sftpClient.Create(remoteArchive)
+	if err != nil {
+		err = fmt.Errorf("create remote file failure, file: %s, error: %s", remoteArchive, err)
+		return
+	}
+
+	defer sftpClient.Remove(remoteArchive)
+
+	counter.w = remoteFile
+	err = writeArchive(counter, opts.Format, ignore, localPath)
+	remoteFile.Close()
+
+	if err != nil {
+		return
+	}
+
+	return cli.Exec(opts.extractCommand(targetDir, remoteArchive))
+}
+
+// writeArchive writes localPath as a compressed tarball to w, entries are
+// prefixed with the base name of localPath, the same layout as file mode
+func writeArchive(w io.Writer, format string, ignore []string, localPath string) (err error) {
+
+	var compressor io.WriteCloser
+
+	switch format {
+	case "tar.zst":
+		compressor, err = zstd.NewWriter(w)
+		if err != nil {
+			return
+		}
+	default:
+		compressor = gzip.NewWriter(w)
+	}
+
+	tw := tar.NewWriter(compressor)
+
+	localPath = filepath.Clean(localPath)
+	base := filepath.Base(localPath)
+
+	err = filepath.Walk(localPath,
+		func(file string, info os.FileInfo, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+
+			ignored, e := isIgnored(ignore, info.Name())
+			if e != nil {
+				return e
+			}
+
+			if ignored {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			relPath, e := filepath.Rel(localPath, file)
+			if e != nil {
+				return e
+			}
+
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, e = os.Readlink(file)
+				if e != nil {
+					return e
+				}
+			}
+
+			header, e := tar.FileInfoHeader(info, link)
+			if e != nil {
+				return e
+			}
+
+			header.Name = filepath.ToSlash(filepath.Join(base, relPath))
+			if info.IsDir() {
+				header.Name += "/"
+			}
+
+			if e = tw.WriteHeader(header); e != nil {
+				return e
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			f, e := os.Open(file)
+			if e != nil {
+				return e
+			}
+			defer f.Close()
+
+			_, e = io.Copy(tw, f)
+			return e
+		},
+	)
+
+	if err != nil {
+		return
+	}
+
+	if err = tw.Close(); err != nil {
+		return
+	}
+
+	return compressor.Close()
+}
@@ -119,6 +119,24 @@ func (s *Client) Exec(cmd string) error {
 	return err
 }
 
+func (s *Client) Pipe(cmd string, stdin io.Reader) error {
+	if s.client == nil {
+		return errors.New("Not connected")
+	}
+
+	session, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = s.Stdout
+	session.Stderr = s.Stderr
+
+	return session.Run(cmd)
+}
+
 func (s *Command) fullCommand() string {
 	var arguments []string
 	// TODO: This method is compatible only with Bjourne compatible shells
@@ -9,7 +9,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/flow-contrib/toolkit/utils/secret"
 	"github.com/gogap/config"
 	"github.com/gogap/context"
 	"github.com/gogap/flow"
@@ -42,7 +44,6 @@ func Run(ctx context.Context, conf config.Configuration) (err error) {
 	}
 
 	user := conf.GetString("user")
-	password := conf.GetString("password")
 	host := conf.GetString("host", "localhost")
 	port := conf.GetString("port", "22")
 	identityFile := conf.GetString("identity-file")
@@ -60,6 +61,16 @@ func Run(ctx context.Context, conf config.Configuration) (err error) {
 		return
 	}
 
+	password, err := secret.Resolve(ctx, conf, "password")
+	if err != nil {
+		return
+	}
+
+	secretEnvs, maskedEnvs, err := secret.ResolveEnvironment(ctx, conf.GetConfig("secret-environment"))
+	if err != nil {
+		return
+	}
+
 	errWriter := bytes.NewBuffer(nil)
 	outWriter := bytes.NewBuffer(nil)
 
@@ -104,7 +115,7 @@ func Run(ctx context.Context, conf config.Configuration) (err error) {
 	}
 
 	cmd := Command{
-		Environment: envs,
+		Environment: append(envs[:len(envs):len(envs)], secretEnvs...),
 		Command:     command,
 		Stdin:       stdin,
 	}
@@ -122,6 +133,9 @@ func Run(ctx context.Context, conf config.Configuration) (err error) {
 
 	outputName := conf.GetString("output.name")
 
+	// the secrets are masked in output
+	cmd.Environment = append(envs[:len(envs):len(envs)], maskedEnvs...)
+
 	outputData, err := json.Marshal(OutputValue{
 		Host:    host,
 		User:    user,
@@ -155,7 +169,6 @@ func Upload(ctx context.Context, conf config.Configuration) (err error) {
 	}
 
 	user := conf.GetString("user")
-	password := conf.GetString("password")
 	host := conf.GetString("host", "localhost")
 	port := conf.GetString("port", "22")
 	identityFile := conf.GetString("identity-file")
@@ -163,6 +176,18 @@ func Upload(ctx context.Context, conf config.Configuration) (err error) {
 	maxPacket := conf.GetInt32("max-packet", 20480)
 	quiet := conf.GetBoolean("quiet")
 	ignore := conf.GetStringList("ignore")
+	mode := conf.GetString("mode", "file")
+	archiveConf := conf.GetConfig("archive")
+
+	if mode != "file" && mode != "archive" {
+		err = fmt.Errorf("unknown upload mode: %s, should be 'file' or 'archive'", mode)
+		return
+	}
+
+	password, err := secret.Resolve(ctx, conf, "password")
+	if err != nil {
+		return
+	}
 
 	cli := Client{
 		Config: Config{
@@ -185,6 +210,11 @@ func Upload(ctx context.Context, conf config.Configuration) (err error) {
 
 	var sftpClient *sftp.Client
 	sftpClient, err = sftp.NewClient(cli.client, sftp.MaxPacket(int(maxPacket)))
+	if err != nil {
+		return
+	}
+
+	defer sftpClient.Close()
 
 	mapFiles := map[string]string{}
 	fileOrder := []string{}
@@ -201,6 +231,41 @@ func Upload(ctx context.Context, conf config.Configuration) (err error) {
 		fileOrder = append(fileOrder, items[0])
 	}
 
+	if mode == "archive" {
+		opts := archiveOptions{
+			Format:          archiveConf.GetString("format", "tar.gz"),
+			Transport:       archiveConf.GetString("transport", "stream"),
+			StripComponents: int(archiveConf.GetInt32("strip-components", 0)),
+			Release:         archiveConf.GetBoolean("release", false),
+			ReleaseName:     archiveConf.GetString("release-name", time.Now().Format("20060102150405")),
+			CurrentLink:     archiveConf.GetString("current-link", "current"),
+		}
+
+		var remoteRoots []string
+
+		for _, file := range fileOrder {
+			err = uploadArchive(&cli, sftpClient, quiet, opts, ignore, file, mapFiles[file])
+			if err != nil {
+				return
+			}
+
+			remoteRoots = appendUnique(remoteRoots, mapFiles[file])
+		}
+
+		if !opts.Release {
+			return
+		}
+
+		// the release is switched only after every archive is extracted
+		for _, remoteRoot := range remoteRoots {
+			if err = flipRelease(&cli, opts, remoteRoot); err != nil {
+				return
+			}
+		}
+
+		return
+	}
+
 	for _, file := range fileOrder {
 
 		var fi os.FileInfo
@@ -224,18 +289,16 @@ func Upload(ctx context.Context, conf config.Configuration) (err error) {
 
 					remotePath := filepath.Join(remoteDirRoot, localDirBase, relPath)
 
-					for _, pattern := range ignore {
-						matched, matchErr := filepath.Match(pattern, info.Name())
-						if matched {
-							if info.IsDir() {
-								return filepath.SkipDir
-							}
-							return nil
-						}
+					ignored, e := isIgnored(ignore, info.Name())
+					if e != nil {
+						return e
+					}
 
-						if matchErr != nil {
-							return matchErr
+					if ignored {
+						if info.IsDir() {
+							return filepath.SkipDir
 						}
+						return nil
 					}
 
 					if info.IsDir() {
@@ -330,3 +393,27 @@ func uploadFile(sftpClient *sftp.Client, quiet bool, maxPacket int32, fi os.File
 
 	return
 }
+
+func isIgnored(ignore []string, name string) (bool, error) {
+	for _, pattern := range ignore {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return false, err
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, v := range items {
+		if v == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
@@ -0,0 +1,151 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gogap/config"
+	"github.com/gogap/context"
+	"github.com/gogap/flow"
+)
+
+// Mask replaces the secrets in outputs
+const Mask = "******"
+
+// Resolve reads the secret of key from config, the first configured one of
+// the following keys is used:
+//
+//	<key>                  plain text
+//	<key>-file             content of file, the trailing newline is trimmed
+//	<key>-env              environment variable
+//	<key>-from-output      output of previous step, e.g.: toolkit.pwgen.generate or toolkit.readline.password.read
+//
+// The value should never be written to outputs or logs.
+func Resolve(ctx context.Context, conf config.Configuration, key string) (value string, err error) {
+
+	if value = conf.GetString(key); len(value) > 0 {
+		return
+	}
+
+	if file := conf.GetString(key + "-file"); len(file) > 0 {
+		var data []byte
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			err = fmt.Errorf("read %s-file failure: %s", key, err)
+			return
+		}
+
+		value = strings.TrimRight(string(data), "\r\n")
+		return
+	}
+
+	if env := conf.GetString(key + "-env"); len(env) > 0 {
+		var exist bool
+		value, exist = os.LookupEnv(env)
+		if !exist {
+			err = fmt.Errorf("environment variable %s of %s-env is not set", env, key)
+		}
+		return
+	}
+
+	if outputName := conf.GetString(key + "-from-output"); len(outputName) > 0 {
+		tags := conf.GetStringList(key + "-from-output-tags")
+
+		outputs := flow.FindOutput(ctx, outputName, tags...)
+
+		if len(outputs) == 0 {
+			err = fmt.Errorf("output of %s-from-output not found, name: %s, tags: %s", key, outputName, strings.Join(tags, ","))
+			return
+		} else if len(outputs) > 1 {
+			err = fmt.Errorf("conflict of output name: %s, tags: %s, set %s-from-output-tags to filter", outputName, strings.Join(tags, ","), key)
+			return
+		}
+
+		value, err = valueOfOutput(outputs[0].Value, conf.GetString(key+"-from-output-field"))
+		if err != nil {
+			err = fmt.Errorf("read %s-from-output failure, name: %s: %s", key, outputName, err)
+		}
+
+		return
+	}
+
+	return
+}
+
+// valueOfOutput reads the field of output, by default, it is 'plain' of pwgen,
+// 'input' of readline, or the output itself if it is a string
+func valueOfOutput(data []byte, field string) (value string, err error) {
+
+	if err = json.Unmarshal(data, &value); err == nil {
+		return
+	}
+
+	fields := map[string]interface{}{}
+
+	if err = json.Unmarshal(data, &fields); err != nil {
+		err = fmt.Errorf("the output is neither a string nor an object")
+		return
+	}
+
+	candidates := []string{"plain", "input"}
+	if len(field) > 0 {
+		candidates = []string{field}
+	}
+
+	for _, name := range candidates {
+		v, exist := fields[name]
+		if !exist {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			err = fmt.Errorf("field %s is not a string", name)
+			return
+		}
+
+		value = s
+		return
+	}
+
+	err = fmt.Errorf("field %s not found", strings.Join(candidates, " or "))
+
+	return
+}
+
+// ResolveEnvironment resolves the environment variables of which values are
+// secrets, e.g.:
+//
+//	secret-environment {
+//	    DB_PASSWORD { value-env = "PROD_DB_PASSWORD" }
+//	}
+//
+// envs are passed to the command, and masked are the same variables with
+// the values replaced, which could be written to outputs
+func ResolveEnvironment(ctx context.Context, conf config.Configuration) (envs []string, masked []string, err error) {
+
+	if conf.IsEmpty() {
+		return
+	}
+
+	names := conf.Keys()
+	sort.Strings(names)
+
+	for _, name := range names {
+		var value string
+		value, err = Resolve(ctx, conf.GetConfig(name), "value")
+		if err != nil {
+			err = fmt.Errorf("resolve secret environment %s failure: %s", name, err)
+			return
+		}
+
+		envs = append(envs, name+"="+value)
+		masked = append(masked, name+"="+Mask)
+	}
+
+	return
+}